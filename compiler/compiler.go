@@ -0,0 +1,99 @@
+// Package compiler compiles GoT templates into Go code from within a Go program.
+//
+// It gives build tools and tests the same result as running the got command, without
+// shelling out to it and without writing to the file system.
+//
+//	code, err := compiler.Compile(strings.NewReader(tmpl), compiler.Options{
+//		FileName:     "hello.tpl.got",
+//		IncludePaths: []string{"templates/inc"},
+//	})
+package compiler
+
+import (
+	"io"
+
+	"github.com/goradd/got/internal/got"
+)
+
+// Options control how a template is compiled.
+type Options struct {
+	// FileName is the name of the template being compiled. It is used when reporting errors,
+	// and to find include files that are relative to the template. It also sets the value of the
+	// predefined templatePath, templateName, templateRoot and templateParent fragments.
+	// The file itself is not read.
+	FileName string
+	// OutPath is the path the generated code is intended to be written to. It only sets the value
+	// of the predefined outPath, outName, outRoot and outParent fragments.
+	OutPath string
+	// IncludePaths are the directories to search for include files, in the order given.
+	// The directory of FileName, or the current working directory if FileName is empty,
+	// is searched last.
+	IncludePaths []string
+	// IncludeFiles are GoT files that are processed and prepended to the template, like files given to the -I option
+	// of the got command.
+	IncludeFiles []string
+	// LineDirectives adds line directives to the generated code, so that errors from the Go compiler and
+	// stack traces from panics refer to lines in the template rather than the generated code. File names in the
+	// directives are relative to the directory of OutPath if it is given, and otherwise are absolute.
+	LineDirectives bool
+	// MaxErrors is the number of errors to report before giving up. Zero means the default of 10,
+	// and a negative number means there is no limit. All the errors are returned together in one error.
+	MaxErrors int
+	// MaxExpansionDepth is how deeply named blocks and include files may be nested inside each other.
+	// Zero means the default of 100, and a negative number means there is no limit. A block or include file
+	// that expands itself, directly or indirectly, is always reported as an error.
+	MaxExpansionDepth int
+	// AutoEscape escapes every value to suit where it lands in the surrounding HTML, whether that is text,
+	// an attribute, a URL, a script or a style sheet. The generated code calls the escaping functions
+	// in the github.com/goradd/got/gotrt package, which is added to its imports.
+	AutoEscape bool
+	// EscapeByDefault html escapes string, byte slice and Stringer values even if the tag does not have the ! prefix,
+	// as if the template started with an {{escape on}} tag. The raw tag outputs a string as is.
+	EscapeByDefault bool
+	// Translator is the Go expression for the gotrt.MessageTranslator that msg tags translate their messages with,
+	// like "ctx.Translator()". If it is empty, they use gotrt.Messages.
+	Translator string
+	// TextTranslator is the Go expression for the gotrt.Translator that translate tags translate their text with,
+	// like "ctx.TextTranslator()". If it is empty, they use gotrt.Texts.
+	TextTranslator string
+}
+
+// Compile reads a GoT template from src and returns the generated Go source code.
+// If the output is a complete Go file, the packages that the generated code uses are added to its imports, and it is formatted.
+//
+// Include files referred to by the template are read from the file system, but nothing is written.
+// Compile may be called concurrently.
+func Compile(src io.Reader, opts Options) ([]byte, error) {
+	return got.Compile(src, opts.internal())
+}
+
+// Diagnostic describes a problem found in a template. See Diagnostics.
+type Diagnostic = got.Diagnostic
+
+// Location is a position in a template file or named block.
+type Location = got.Location
+
+// TemplateError is the type of error returned by Compile when the template has problems.
+type TemplateError = got.TemplateError
+
+// Diagnostics returns the individual problems described by an error returned by Compile.
+// Compile reports all the problems it finds in a template at once, up to Options.MaxErrors.
+func Diagnostics(err error) []Diagnostic {
+	return got.Diagnostics(err)
+}
+
+func (o Options) internal() got.CompileOptions {
+	return got.CompileOptions{
+		FileName:          o.FileName,
+		OutPath:           o.OutPath,
+		IncludePaths:      o.IncludePaths,
+		IncludeFiles:      o.IncludeFiles,
+		LineDirectives:    o.LineDirectives,
+		MaxErrors:         o.MaxErrors,
+		MaxExpansionDepth: o.MaxExpansionDepth,
+		AutoEscape:        o.AutoEscape,
+		EscapeByDefault:   o.EscapeByDefault,
+		Translator:        o.Translator,
+		TextTranslator:    o.TextTranslator,
+	}
+}
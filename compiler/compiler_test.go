@@ -0,0 +1,71 @@
+package compiler
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var incPath = filepath.Join("..", "internal", "testdata", "src", "inc")
+
+func TestCompile(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		out, err := Compile(strings.NewReader("{{ Hello }}"), Options{})
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), "io.WriteString(_w, `Hello `)")
+	})
+
+	t.Run("predefined blocks", func(t *testing.T) {
+		out, err := Compile(strings.NewReader("{{ {{templateRoot}}-{{outName}} }}"), Options{
+			FileName: "hello.tpl.got",
+			OutPath:  "out/hello.tpl.go",
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), "`hello`")
+		assert.Contains(t, string(out), "`hello.tpl.go`")
+	})
+
+	t.Run("include paths", func(t *testing.T) {
+		out, err := Compile(strings.NewReader(`{{ {{: "incSub/incSub.inc" }} }}`), Options{
+			IncludePaths: []string{filepath.Join("..", "internal", "testdata", "src", "inc2"), incPath},
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), "`right`")
+	})
+
+	t.Run("include files", func(t *testing.T) {
+		out, err := Compile(strings.NewReader(`{{printYou}}`), Options{
+			IncludeFiles: []string{filepath.Join(incPath, "testInclude4.inc")},
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, string(out), "You")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, err := Compile(strings.NewReader("{{i }}"), Options{FileName: "bad.tpl.got"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "bad.tpl.got")
+	})
+
+	t.Run("empty include", func(t *testing.T) {
+		_, err := Compile(strings.NewReader("package a\n{{: }}\n"), Options{FileName: "bad.tpl.got"})
+		if diags := Diagnostics(err); assert.Len(t, diags, 1) {
+			assert.Contains(t, diags[0].Message, "expected a file name in include tag")
+			assert.Equal(t, 2, diags[0].Location.Line)
+		}
+
+		_, err = Compile(strings.NewReader(`{{: "" }}`), Options{})
+		assert.ErrorContains(t, err, "expected a file name in include tag")
+	})
+
+	t.Run("diagnostics", func(t *testing.T) {
+		_, err := Compile(strings.NewReader("{{i }}\n{{if}}"), Options{FileName: "bad.tpl.got"})
+		diags := Diagnostics(err)
+		if assert.Len(t, diags, 2) {
+			assert.Equal(t, 1, diags[0].Location.Line)
+			assert.Equal(t, 2, diags[1].Location.Line)
+		}
+	})
+}
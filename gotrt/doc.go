@@ -0,0 +1,17 @@
+// Package gotrt is the run time support for code generated by GoT.
+//
+// It has the escaping functions used by templates compiled with contextual escaping, a Writer that templates can
+// write to, a pool of buffers to render templates into, the Translator interface used by translate tags,
+// the MessageTranslator interface used by msg tags, and an Error type that records where in a template an error happened.
+//
+// Templates compiled with contextual escaping call the escaping functions, templates with translate tags call a
+// Translator, templates with msg tags call a MessageTranslator, and templates with tags that output a value along with
+// an error wrap the error with WrapError. GoT adds this package to their imports.
+// Other templates can use the rest of the package as they see fit.
+//
+// # Escaping
+//
+// GoT picks the escaping function to call from where a value lands in the surrounding HTML, so that a value cannot
+// change the meaning of the page. Values of the types in the html/template package, like template.HTML and template.URL,
+// are trusted by the functions for the matching context, and are output without being escaped.
+package gotrt
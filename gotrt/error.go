@@ -0,0 +1,40 @@
+package gotrt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error is an error returned by code that a template called, along with where in the template the call is.
+type Error struct {
+	// Template is the name of the template file.
+	Template string
+	// Line is the line in the template, starting at 1.
+	Line int
+	// Err is the error that was returned.
+	Err error
+}
+
+// Error returns the error message, prefixed by the template location.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Template, e.Line, e.Err.Error())
+}
+
+// Unwrap returns the error that was returned, so that errors.Is and errors.As can find it.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// WrapError returns err wrapped in an Error that records the given template location, or nil if err is nil.
+// If err already has a template location, it is returned as is, so that the location closest to where the error happened
+// is the one reported when templates call other templates.
+func WrapError(err error, template string, line int) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Template: template, Line: line, Err: err}
+}
@@ -0,0 +1,246 @@
+package gotrt
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+	"unicode/utf8"
+)
+
+// Unsafe is output in place of a value that could not be made safe for its context.
+const Unsafe = "ZgotmplZ"
+
+// toString converts a value to the string that would be output without escaping.
+func toString(v any) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case fmt.Stringer:
+		return s.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// EscapeHTML escapes v for use as HTML text. A template.HTML value is output as is.
+func EscapeHTML(v any) string {
+	if h, ok := v.(template.HTML); ok {
+		return string(h)
+	}
+	return html.EscapeString(toString(v))
+}
+
+// EscapeRCDATA escapes v for use in an element that can only hold text, like a textarea, or in an HTML comment.
+// Unlike EscapeHTML, it escapes template.HTML values too.
+func EscapeRCDATA(v any) string {
+	return html.EscapeString(toString(v))
+}
+
+// EscapeAttr escapes v for use in a quoted attribute value.
+func EscapeAttr(v any) string {
+	return html.EscapeString(toString(v))
+}
+
+// EscapeAttrUnquoted escapes v for use in an attribute value that is not in quotes. Besides the characters
+// that EscapeAttr escapes, it escapes the white space and other characters that would end the value.
+func EscapeAttrUnquoted(v any) string {
+	s := toString(v)
+	if s == "" {
+		// an empty value would let the next attribute become the value
+		return Unsafe
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\t', '\n', '\f', '\r', ' ', '"', '&', '\'', '+', '<', '=', '>', '`', 0:
+			fmt.Fprintf(&b, "&#%d;", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// EscapeAttrName makes sure that v is safe to use where the name of a tag or an attribute goes.
+// A name that could start a script, a style or a URL is replaced with Unsafe. A template.HTMLAttr value is output as is.
+func EscapeAttrName(v any) string {
+	if a, ok := v.(template.HTMLAttr); ok {
+		return string(a)
+	}
+	s := toString(v)
+	if s == "" {
+		return Unsafe
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == ':') {
+			return Unsafe
+		}
+	}
+	lower := strings.ToLower(s)
+	if strings.HasPrefix(lower, "on") || lower == "style" || IsURLAttr(lower) {
+		return Unsafe
+	}
+	return s
+}
+
+// IsURLAttr reports whether the attribute with the given lower case name has a URL as its value.
+func IsURLAttr(name string) bool {
+	name = strings.TrimPrefix(name, "data-")
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:] // a namespace, like xlink:href
+	}
+	switch name {
+	case "action", "archive", "background", "cite", "classid", "codebase", "data", "formaction",
+		"href", "icon", "longdesc", "manifest", "poster", "profile", "src", "srcset", "usemap":
+		return true
+	}
+	return strings.Contains(name, "src") || strings.Contains(name, "uri") || strings.Contains(name, "url")
+}
+
+// EscapeJS converts v to a JavaScript value, like a number, a quoted string or an object. A template.JS value is output as is,
+// and a template.JSStr value is put in quotes.
+func EscapeJS(v any) string {
+	switch j := v.(type) {
+	case template.JS:
+		return string(j)
+	case template.JSStr:
+		return `"` + string(j) + `"`
+	case []byte:
+		v = string(j)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "null"
+	}
+	s := string(b)
+	if s[0] == '-' {
+		// keep a negative number from joining with a minus sign in front of it to make a decrement operator
+		s = " " + s
+	}
+	return s
+}
+
+// EscapeJSString escapes v for use inside of a JavaScript string or template literal. A template.JSStr value is output as is.
+func EscapeJSString(v any) string {
+	if j, ok := v.(template.JSStr); ok {
+		return string(j)
+	}
+	s := toString(v)
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\'':
+			b.WriteString(`\'`)
+		case '"':
+			b.WriteString(`\"`)
+		case '`':
+			b.WriteString("\\`")
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '<', '>', '&', '=', '$', '/', '\u2028', '\u2029':
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// EscapeCSS makes sure that v is safe to use as a CSS value, like a color, a length or a keyword. A value with anything else
+// in it, like a quote, a parenthesis or a comment, is replaced with Unsafe. A template.CSS value is output as is.
+func EscapeCSS(v any) string {
+	if c, ok := v.(template.CSS); ok {
+		return string(c)
+	}
+	s := toString(v)
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(" #%,.-_!+/", r)) {
+			return Unsafe
+		}
+	}
+	if strings.Contains(s, "/*") || strings.Contains(s, "//") {
+		return Unsafe
+	}
+	return s
+}
+
+// EscapeCSSString escapes v for use inside of a CSS string or comment.
+func EscapeCSSString(v any) string {
+	s := toString(v)
+	var b strings.Builder
+	for i, r := range s {
+		switch r {
+		case 0, '\t', '\n', '\f', '\r', '"', '&', '\'', '(', ')', '+', '/', ':', ';', '<', '>', '\\', '{', '}':
+			fmt.Fprintf(&b, `\%x`, r)
+			// a space ends the escape if the next character could be taken as part of it
+			if next, _ := utf8.DecodeRuneInString(s[i+1:]); next == ' ' || isHex(next) {
+				b.WriteByte(' ')
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func isHex(r rune) bool {
+	return r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F'
+}
+
+// EscapeURL makes v safe to use as a whole URL, or as the start of one. A URL with a scheme other than
+// http, https or mailto, like a javascript: URL, is replaced with "#ZgotmplZ". Characters that are not allowed in a URL are percent encoded.
+// A template.URL value is trusted to have a safe scheme.
+func EscapeURL(v any) string {
+	if u, ok := v.(template.URL); ok {
+		return NormalizeURL(string(u))
+	}
+	s := toString(v)
+	if i := strings.IndexAny(s, ":/?#"); i >= 0 && s[i] == ':' {
+		switch strings.ToLower(s[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "#" + Unsafe
+		}
+	}
+	return NormalizeURL(s)
+}
+
+// NormalizeURL percent encodes the characters in v that are not allowed in a URL, while leaving the characters
+// that separate the parts of a URL. It is used for a value in the middle of a URL, before any query.
+func NormalizeURL(v any) string {
+	return encodeURL(toString(v), true)
+}
+
+// EscapeURLQuery percent encodes v for use in the query or fragment of a URL.
+func EscapeURLQuery(v any) string {
+	return encodeURL(toString(v), false)
+}
+
+func encodeURL(s string, keepReserved bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case keepReserved && strings.IndexByte("!#$%&*+,/:;=?@[]", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
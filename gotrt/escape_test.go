@@ -0,0 +1,85 @@
+package gotrt
+
+import (
+	"html/template"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stringer struct{}
+
+func (stringer) String() string { return "<b>" }
+
+func TestEscapeHTML(t *testing.T) {
+	assert.Equal(t, "&lt;a href=&#34;x&#34;&gt;", EscapeHTML(`<a href="x">`))
+	assert.Equal(t, "&lt;b&gt;", EscapeHTML(stringer{}))
+	assert.Equal(t, "&lt;b&gt;", EscapeHTML([]byte("<b>")))
+	assert.Equal(t, "5", EscapeHTML(5))
+	assert.Equal(t, "<b>", EscapeHTML(template.HTML("<b>")))
+	assert.Equal(t, "&lt;b&gt;", EscapeRCDATA(template.HTML("<b>")))
+}
+
+func TestEscapeAttr(t *testing.T) {
+	assert.Equal(t, "a&#39;b&#34;c", EscapeAttr(`a'b"c`))
+	assert.Equal(t, "a&#32;b&#61;c", EscapeAttrUnquoted("a b=c"))
+	assert.Equal(t, Unsafe, EscapeAttrUnquoted(""))
+
+	assert.Equal(t, "title", EscapeAttrName("title"))
+	assert.Equal(t, "data-id", EscapeAttrName("data-id"))
+	assert.Equal(t, Unsafe, EscapeAttrName("onclick"))
+	assert.Equal(t, Unsafe, EscapeAttrName("HREF"))
+	assert.Equal(t, Unsafe, EscapeAttrName("style"))
+	assert.Equal(t, Unsafe, EscapeAttrName("a b"))
+	assert.Equal(t, Unsafe, EscapeAttrName(""))
+	assert.Equal(t, "onclick", EscapeAttrName(template.HTMLAttr("onclick")))
+}
+
+func TestIsURLAttr(t *testing.T) {
+	assert.True(t, IsURLAttr("href"))
+	assert.True(t, IsURLAttr("xlink:href"))
+	assert.True(t, IsURLAttr("data-src"))
+	assert.True(t, IsURLAttr("imgurl"))
+	assert.False(t, IsURLAttr("title"))
+}
+
+func TestEscapeJS(t *testing.T) {
+	assert.Equal(t, `"a\u003c/script\u003e"`, EscapeJS("a</script>"))
+	assert.Equal(t, `5`, EscapeJS(5))
+	assert.Equal(t, ` -5`, EscapeJS(-5))
+	assert.Equal(t, `true`, EscapeJS(true))
+	assert.Equal(t, `"abc"`, EscapeJS([]byte("abc")))
+	assert.Equal(t, `{"a":[1,2]}`, EscapeJS(map[string][]int{"a": {1, 2}}))
+	assert.Equal(t, `null`, EscapeJS(func() {}))
+	assert.Equal(t, `f()`, EscapeJS(template.JS("f()")))
+	assert.Equal(t, `"a\'b"`, EscapeJS(template.JSStr(`a\'b`)))
+
+	assert.Equal(t, `a\'b\"c\\d\n\u003C\u002F`, EscapeJSString("a'b\"c\\d\n</"))
+	assert.Equal(t, "\\`\\u0024{x}", EscapeJSString("`${x}"))
+	assert.Equal(t, `\u2028`, EscapeJSString("\u2028"))
+	assert.Equal(t, `a'b`, EscapeJSString(template.JSStr(`a'b`)))
+}
+
+func TestEscapeCSS(t *testing.T) {
+	assert.Equal(t, "#fff", EscapeCSS("#fff"))
+	assert.Equal(t, "10px 2em", EscapeCSS("10px 2em"))
+	assert.Equal(t, Unsafe, EscapeCSS("red; background: url(x)"))
+	assert.Equal(t, Unsafe, EscapeCSS("expression(alert(1))"))
+	assert.Equal(t, Unsafe, EscapeCSS("a/*b"))
+	assert.Equal(t, "url(x)", EscapeCSS(template.CSS("url(x)")))
+
+	assert.Equal(t, `a\22 b`, EscapeCSSString(`a"b`))
+	assert.Equal(t, `\3c a`, EscapeCSSString(`<a`))
+	assert.Equal(t, `\3cz`, EscapeCSSString(`<z`))
+}
+
+func TestEscapeURL(t *testing.T) {
+	assert.Equal(t, "http://a.com/b%20c?d=e", EscapeURL("http://a.com/b c?d=e"))
+	assert.Equal(t, "/path/x", EscapeURL("/path/x"))
+	assert.Equal(t, "mailto:a@b.com", EscapeURL("mailto:a@b.com"))
+	assert.Equal(t, "#"+Unsafe, EscapeURL("javascript:alert(1)"))
+	assert.Equal(t, "#"+Unsafe, EscapeURL(" JavaScript:alert(1)"))
+	assert.Equal(t, "javascript:f%28%29", EscapeURL(template.URL("javascript:f()")))
+	assert.Equal(t, "a/b%22c", NormalizeURL(`a/b"c`))
+	assert.Equal(t, "a%2Fb%26c%3Dd", EscapeURLQuery("a/b&c=d"))
+}
@@ -0,0 +1,130 @@
+package gotrt
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Translator translates the text of a template into the language of the reader.
+// The translate tags of a template call the Translate method of Texts, or of the Translator that GoT is given
+// with its -textTranslator option.
+type Translator interface {
+	Translate(s string) string
+}
+
+// TranslatorFunc lets a function be used as a Translator.
+type TranslatorFunc func(s string) string
+
+// Translate calls f(s).
+func (f TranslatorFunc) Translate(s string) string {
+	return f(s)
+}
+
+// NoTranslation is a Translator that returns the text of a template as is.
+var NoTranslation Translator = TranslatorFunc(func(s string) string { return s })
+
+// Texts is the Translator that translate tags use, unless GoT is given a different one with its -textTranslator option.
+// An application that shows one language at a time can set it when it starts.
+var Texts = NoTranslation
+
+// Arg is a named value that is put in the text of a Message.
+type Arg struct {
+	Name  string
+	Value any
+}
+
+// Message is the text of a msg tag, along with what a translator needs to know to translate it.
+type Message struct {
+	// ID identifies the message, if the template gave it one. Otherwise, the message is identified by its text and context.
+	ID string
+	// Context tells apart messages that have the same text but need different translations.
+	Context string
+	// Text is the text of the message in the language of the template. Values are put in it with {name} placeholders.
+	Text string
+	// Plural is the text to use when Count is not one. It is empty if the message does not have a plural.
+	Plural string
+	// Count is the number that decides which plural form of the message to use. It is put in the text with
+	// the {count} placeholder.
+	Count int
+	// Args are the values to put in the text.
+	Args []Arg
+}
+
+// Source returns the text of m in the language of the template. That is Plural if m has one and Count is not one,
+// and Text otherwise.
+func (m Message) Source() string {
+	if m.Plural != "" && m.Count != 1 {
+		return m.Plural
+	}
+	return m.Text
+}
+
+// Format returns text with its {name} placeholders replaced by the values of the Args with those names.
+// The {count} placeholder is replaced by Count, unless there is an Arg named count. Placeholders that do not
+// name a value are left as is.
+func (m Message) Format(text string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(text, '{')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(text[i:], '}')
+		if j < 0 {
+			break
+		}
+		b.WriteString(text[:i])
+		if v, ok := m.value(text[i+1 : i+j]); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(text[i : i+j+1])
+		}
+		text = text[i+j+1:]
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// value returns the value of the placeholder with the given name as a string.
+func (m Message) value(name string) (string, bool) {
+	for _, a := range m.Args {
+		if a.Name == name {
+			return toString(a.Value), true
+		}
+	}
+	if name == "count" {
+		return strconv.Itoa(m.Count), true
+	}
+	return "", false
+}
+
+// MessageTranslator translates the messages of msg tags into the language of the reader. A translator would typically
+// look up the translation of m in the form that suits m.Count, and return m.Format(translation).
+type MessageTranslator interface {
+	TranslateMessage(m Message) string
+}
+
+// MessageTranslatorFunc lets a function be used as a MessageTranslator.
+type MessageTranslatorFunc func(m Message) string
+
+// TranslateMessage calls f(m).
+func (f MessageTranslatorFunc) TranslateMessage(m Message) string {
+	return f(m)
+}
+
+// Untranslated is a MessageTranslator that returns messages in the language of the template.
+var Untranslated MessageTranslator = MessageTranslatorFunc(func(m Message) string {
+	return m.Format(m.Source())
+})
+
+// Messages is the MessageTranslator that msg tags use, unless GoT is given a different one with its -translator option.
+// An application that shows one language at a time can set it when it starts.
+var Messages = Untranslated
+
+// TextTranslator returns a MessageTranslator that translates the text of a message with t, and then puts its values in it.
+// The id and context of the message are not used.
+func TextTranslator(t Translator) MessageTranslator {
+	return MessageTranslatorFunc(func(m Message) string {
+		return m.Format(t.Translate(m.Source()))
+	})
+}
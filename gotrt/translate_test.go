@@ -0,0 +1,31 @@
+package gotrt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	m := Message{Text: "{count} file in {dir}", Plural: "{count} files in {dir}", Count: 1, Args: []Arg{{Name: "dir", Value: "/tmp"}}}
+	assert.Equal(t, "{count} file in {dir}", m.Source())
+	assert.Equal(t, "1 file in /tmp", Untranslated.TranslateMessage(m))
+	m.Count = 2
+	assert.Equal(t, "2 files in /tmp", Untranslated.TranslateMessage(m))
+
+	// placeholders without values, and braces that are not placeholders, are left alone
+	assert.Equal(t, "{x} /tmp { {", m.Format("{x} {dir} { {"))
+
+	// an argument named count takes the place of the count
+	m.Args = append(m.Args, Arg{Name: "count", Value: "two"})
+	assert.Equal(t, "two", m.Format("{count}"))
+
+	// without a plural, the text is used for any count
+	assert.Equal(t, "a", Message{Text: "a", Count: 5}.Source())
+}
+
+func TestTextTranslator(t *testing.T) {
+	tr := TextTranslator(TranslatorFunc(func(s string) string { return strings.Replace(s, "hello", "hola", 1) }))
+	assert.Equal(t, "hola bob", tr.TranslateMessage(Message{Text: "hello {name}", Args: []Arg{{Name: "name", Value: "bob"}}}))
+}
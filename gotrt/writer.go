@@ -0,0 +1,79 @@
+package gotrt
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Writer wraps an io.Writer for templates to write to. It counts the bytes written, and remembers the first error,
+// after which writes do nothing. Code that runs a series of templates can then check for an error once, at the end.
+type Writer struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+// NewWriter returns a Writer that writes to w. If w is already a *Writer, it is returned as is.
+func NewWriter(w io.Writer) *Writer {
+	if w2, ok := w.(*Writer); ok {
+		return w2
+	}
+	return &Writer{w: w}
+}
+
+// Write writes p, unless an earlier write failed, in which case it returns the earlier error.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err = w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return
+}
+
+// WriteString writes s, unless an earlier write failed, in which case it returns the earlier error.
+// It lets io.WriteString, which the generated code uses, write without copying s.
+func (w *Writer) WriteString(s string) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err = io.WriteString(w.w, s)
+	w.n += int64(n)
+	w.err = err
+	return
+}
+
+// Len returns the number of bytes written.
+func (w *Writer) Len() int64 {
+	return w.n
+}
+
+// Err returns the first error returned by the wrapped io.Writer, or nil if there was none.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// maxPooledBuffer is the size of the largest buffer kept by PutBuffer. Larger buffers are left for the garbage collector,
+// so that one large page does not keep its memory forever.
+const maxPooledBuffer = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// GetBuffer returns an empty buffer from a pool of buffers, for rendering a template into before sending it somewhere else.
+// Return the buffer with PutBuffer when it is no longer needed.
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer returns a buffer from GetBuffer to the pool. The buffer must not be used afterwards.
+func PutBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
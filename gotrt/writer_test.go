@@ -0,0 +1,91 @@
+package gotrt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failWriter struct {
+	limit int
+}
+
+func (f *failWriter) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		return f.limit, errors.New("full")
+	}
+	f.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	assert.Same(t, w, NewWriter(w))
+
+	_, err := io.WriteString(w, "abc")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte("de"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcde", buf.String())
+	assert.Equal(t, int64(5), w.Len())
+	assert.NoError(t, w.Err())
+
+	w = NewWriter(&failWriter{limit: 4})
+	_, err = w.WriteString("abc")
+	assert.NoError(t, err)
+	_, err = w.WriteString("def")
+	assert.EqualError(t, err, "full")
+	n, err := w.WriteString("g")
+	assert.Equal(t, 0, n)
+	assert.EqualError(t, err, "full")
+	assert.EqualError(t, w.Err(), "full")
+	assert.Equal(t, int64(4), w.Len())
+}
+
+func TestBufferPool(t *testing.T) {
+	b := GetBuffer()
+	assert.Equal(t, 0, b.Len())
+	b.WriteString("abc")
+	PutBuffer(b)
+	b = GetBuffer()
+	assert.Equal(t, 0, b.Len())
+	PutBuffer(b)
+
+	// large buffers are not kept
+	large := GetBuffer()
+	large.WriteString(strings.Repeat("a", maxPooledBuffer+1))
+	PutBuffer(large)
+	b = GetBuffer()
+	assert.NotSame(t, large, b)
+	assert.Equal(t, 0, b.Len())
+	PutBuffer(b)
+}
+
+func TestTranslator(t *testing.T) {
+	var tr Translator = TranslatorFunc(strings.ToUpper)
+	assert.Equal(t, "HI", tr.Translate("hi"))
+	assert.Equal(t, "hi", NoTranslation.Translate("hi"))
+}
+
+func TestWrapError(t *testing.T) {
+	assert.NoError(t, WrapError(nil, "a.got", 1))
+
+	base := errors.New("bad")
+	err := WrapError(base, "a.got", 3)
+	assert.EqualError(t, err, "a.got:3: bad")
+	assert.ErrorIs(t, err, base)
+
+	// the innermost location is kept
+	err2 := WrapError(err, "b.got", 5)
+	assert.Same(t, err, err2)
+	var e *Error
+	if assert.ErrorAs(t, err2, &e) {
+		assert.Equal(t, "a.got", e.Template)
+		assert.Equal(t, 3, e.Line)
+	}
+}
@@ -1,10 +1,14 @@
 package got
 
 import (
+	"bytes"
 	"fmt"
 	"html"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -13,6 +17,7 @@ type astType struct {
 }
 
 type astWalker struct {
+	c          *compilation
 	w          io.Writer
 	textMode   bool
 	escapeText bool
@@ -21,12 +26,19 @@ type astWalker struct {
 
 	// previousOutputEndedInNewline help us concatenate multiple blocks so they don't get extra lines
 	previousOutputEndedInNewline bool
+
+	// atGoStatement is true when the Go code written so far ends between statements, so that a line directive
+	// can be written without landing in the middle of something like a string literal.
+	atGoStatement bool
+
+	// ctx is the HTML context at the end of the text output so far. It is only tracked when contextual escaping is on.
+	ctx htmlContext
 }
 
 // buildAst creates an symbol tree for the given file.
 //
 // named blocks are previously named blocks to use, and that are added to during the process
-func buildAst(fileName string, namedBlocks map[string]namedBlockEntry) (ret astType, err error) {
+func (c *compilation) buildAst(fileName string, namedBlocks map[string]namedBlockEntry) (ret astType, err error) {
 	var inFile *os.File
 	inFile, err = os.Open(fileName)
 	if err != nil {
@@ -36,30 +48,61 @@ func buildAst(fileName string, namedBlocks map[string]namedBlockEntry) (ret astT
 		_ = inFile.Close()
 	}()
 
-	l := lexFile(fileName, inFile, namedBlocks)
+	return c.buildAstFromReader(fileName, inFile, namedBlocks)
+}
+
+// buildAstFromReader creates a symbol tree from the template read from r.
+//
+// fileName is used to report errors and to find include files that are relative to the template.
+func (c *compilation) buildAstFromReader(fileName string, r io.Reader, namedBlocks map[string]namedBlockEntry) (ret astType, err error) {
+	l := lexFile(c, fileName, r, namedBlocks, nil)
 	ret.topItem = parse(l)
 	if ret.topItem.typ == itemError {
-		err = fmt.Errorf(ret.topItem.formatError())
+		err = newTemplateError(ret.topItem)
 	}
 	return
 }
 
-func outputAsts(outPath string, asts ...astType) error {
-	outFile, err := os.Create(outPath)
+// outputAsts writes the go code generated from the asts to the file at outPath. The code is generated in memory first,
+// so that the imports it needs can be added and it can be formatted, and goimports run on it if runImports is true, before it is written.
+// Nothing is written if any of that fails, or if the file already holds the same code. changed is true if the file was written.
+func (c *compilation) outputAsts(outPath string, runImports bool, asts ...astType) (changed bool, err error) {
+	var buf bytes.Buffer
+	if err = c.writeAsts(&buf, filepath.Dir(outPath), asts...); err != nil {
+		if te, ok := err.(*TemplateError); ok {
+			return false, te
+		}
+		return false, fmt.Errorf("Could not write to output file " + outPath + " error: " + err.Error())
+	}
+
+	src, err := c.finishSource(buf.Bytes(), asts)
 	if err != nil {
-		return fmt.Errorf("Could not open output file " + outPath + " error: " + err.Error())
+		return false, err
 	}
-	defer func() {
-		_ = outFile.Close()
-	}()
+	return writeOutput(outPath, src, runImports)
+}
 
-	_, err = io.WriteString(outFile, "//** This file was code generated by GoT. DO NOT EDIT. ***\n\n\n")
+// writeAsts writes the go code generated from the asts to w.
+//
+// If depDir is not empty, the files the code depends on are listed in the header, relative to depDir,
+// so that later runs can tell when the output is out of date.
+func (c *compilation) writeAsts(w io.Writer, depDir string, asts ...astType) error {
+	header := "//** This file was code generated by GoT. DO NOT EDIT. ***\n"
+	if depDir != "" {
+		for _, dep := range c.dependencyList() {
+			if rel, err := filepath.Rel(depDir, dep); err == nil {
+				dep = rel
+			}
+			header += dependencyPrefix + filepath.ToSlash(dep) + "\n"
+		}
+	}
+	_, err := io.WriteString(w, header+"\n\n")
 	if err != nil {
-		return fmt.Errorf("Could not write to output file " + outPath + " error: " + err.Error())
+		return err
 	}
 
 	for _, ast := range asts {
-		walker := astWalker{w: outFile, previousOutputEndedInNewline: true}
+		walker := astWalker{c: c, w: w, previousOutputEndedInNewline: true, atGoStatement: true}
 		err = walker.walk(ast.topItem)
 		if err != nil {
 			break
@@ -70,11 +113,17 @@ func outputAsts(outPath string, asts ...astType) error {
 }
 
 func (a *astWalker) walk(item tokenItem) error {
+	if item.typ != itemRun {
+		// everything other than a run of Go code outputs complete statements
+		defer func() { a.atGoStatement = true }()
+	}
+
 	switch item.typ {
 
 	case itemGo:
 		defer a.setTextMode(a.textMode, a.escapeText, a.htmlBreaks, a.translate)
 		a.setTextMode(false, false, false, false)
+		a.atGoStatement = true
 		return a.walkItems(item.childItems)
 
 	case itemText:
@@ -88,7 +137,7 @@ func (a *astWalker) walk(item tokenItem) error {
 	case itemStrictBlock:
 		defer a.setTextMode(a.textMode, a.escapeText, a.htmlBreaks, a.translate)
 		a.setTextMode(true, item.escaped, item.htmlBreaks, item.translate)
-		return a.outputText(item.val)
+		return a.outputText(item)
 
 	case itemRun:
 		return a.outputRun(item)
@@ -123,9 +172,18 @@ func (a *astWalker) walk(item tokenItem) error {
 	case itemFor:
 		return a.outputFor(item)
 
+	case itemSwitch:
+		return a.outputSwitch(item)
+
 	case itemJoin:
 		return a.outputJoin(item)
 
+	case itemEscape:
+		return nil // the parser has already applied it to the values that follow
+
+	case itemMessage:
+		return a.outputMessage(item)
+
 	default:
 		panic("unexpected token while walking ast")
 	}
@@ -148,10 +206,11 @@ func (a *astWalker) setTextMode(textMode, escapeText, htmlBreaks bool, translate
 	a.translate = translate
 }
 
-// outputText sends plain text to the template. There are some nuances here.
+// outputText sends the plain text of item to the template. There are some nuances here.
 // The val includes the space character that comes after the opening tag. We may
 // or may not use that character, depending on the circumstances.
-func (a *astWalker) outputText(val string) (err error) {
+func (a *astWalker) outputText(item tokenItem) (err error) {
+	val := item.val
 	if val == "" {
 		return
 	}
@@ -178,9 +237,22 @@ func (a *astWalker) outputText(val string) (err error) {
 			val = "<p>" + val + "</p>\n"
 		}
 	}
+	if a.c.autoEscape {
+		// translated text is assumed to leave the context in the same place as the original
+		a.ctx = a.ctx.advance(val)
+	}
+	a.c.addImport("io")
 	if a.translate {
+		if a.c.catalog != nil {
+			a.c.catalog.addItem(item, catalogEntry{Text: val})
+		}
+		translator := "gotrt.Texts"
+		if a.c.textTranslator != "" {
+			translator = "(" + a.c.textTranslator + ")"
+		}
+		a.c.addImport("github.com/goradd/got/gotrt")
 		// Yes, we may be translating html encoded text here.
-		_, err = io.WriteString(a.w, "\nif _,err = io.WriteString(_w, t.Translate("+quoteText(val)+")); err != nil {return}\n")
+		_, err = io.WriteString(a.w, "\nif _,err = io.WriteString(_w, "+translator+".Translate("+quoteText(val)+")); err != nil {return}\n")
 	} else {
 		_, err = io.WriteString(a.w, "\nif _,err = io.WriteString(_w, "+quoteText(val)+"); err != nil {return}\n")
 	}
@@ -189,10 +261,25 @@ func (a *astWalker) outputText(val string) (err error) {
 
 func (a *astWalker) outputRun(item tokenItem) error {
 	if !a.textMode {
-		return a.outputGo(item.val)
+		code := item.val
+		if a.atGoStatement {
+			code = a.lineDirective(item) + code
+		} else if i := strings.IndexByte(code, '\n'); i >= 0 && a.c.sourceItems != nil {
+			// When locating syntax errors, also point the lines after the first one back to the template, since
+			// a line directive at the start of a line is unlikely to change how the code parses.
+			next := item
+			next.callStack = append([]locationRef(nil), item.callStack...)
+			if len(next.callStack) > 0 {
+				next.callStack[0].lineNum++
+				next.callStack[0].offset = 0
+			}
+			code = code[:i+1] + a.lineDirective(next) + code[i+1:]
+		}
+		a.atGoStatement = false
+		return a.outputGo(code)
 	}
 
-	return a.outputText(item.val)
+	return a.outputText(item)
 }
 
 func (a *astWalker) outputGo(code string) (err error) {
@@ -200,6 +287,34 @@ func (a *astWalker) outputGo(code string) (err error) {
 	return
 }
 
+// lineDirective returns a /*line*/ comment that maps the Go code that follows it to the template location
+// of the item, or an empty string if line directives are turned off or the location is not known.
+// The block comment form is used, since it can go in the middle of a line without changing the meaning of the code.
+func (a *astWalker) lineDirective(item tokenItem) string {
+	if a.c.sourceItems != nil {
+		if len(item.callStack) == 0 {
+			return ""
+		}
+		a.c.sourceItems = append(a.c.sourceItems, item)
+		return fmt.Sprintf("/*line %s%d:1:1*/", sourceItemPrefix, len(a.c.sourceItems)-1)
+	}
+	if !a.c.lineDirectives {
+		return ""
+	}
+	ref, ok := item.sourceLocation()
+	if !ok {
+		return ""
+	}
+	fileName := ref.fileName
+	if a.c.lineDirectiveDir != "" {
+		// relative file names are resolved from the directory of the generated file
+		if rel, err := filepath.Rel(a.c.lineDirectiveDir, fileName); err == nil {
+			fileName = rel
+		}
+	}
+	return fmt.Sprintf("/*line %s:%d:%d*/", filepath.ToSlash(fileName), ref.lineNum+1, ref.offset+1)
+}
+
 // outputValue sends a particular value to output
 // outputValue overrides the current text environment, but does not change it
 func (a *astWalker) outputValue(item tokenItem) (err error) {
@@ -238,27 +353,136 @@ func (a *astWalker) outputValue(item tokenItem) (err error) {
 		formatter = `%s`
 	}
 
+	if a.c.autoEscape {
+		if item.raw {
+			a.ctx = a.ctx.afterValue()
+		} else {
+			writer, formatter = a.contextWriter(item, formatter)
+		}
+	}
+
+	a.useHelpers(writer + formatter)
+
 	var out string
+	val := a.lineDirective(item) + item.val
 
 	if item.withError {
 		out = fmt.Sprintf(`
 {
 	_v,_err2 := %s
 	if _,err = %s; err != nil {return}
-	if _err2 != nil {return err}
+	if _err2 != nil {return %s}
 }
-`, item.val,
-			fmt.Sprintf(writer, fmt.Sprintf(formatter, "_v")))
+`, val,
+			fmt.Sprintf(writer, fmt.Sprintf(formatter, "_v")),
+			a.wrapError(item, "_err2"))
 	} else {
-		out = fmt.Sprintf("\n if _,err = %s; err != nil {return}\n", fmt.Sprintf(writer, fmt.Sprintf(formatter, item.val)))
+		out = fmt.Sprintf("\n if _,err = %s; err != nil {return}\n", fmt.Sprintf(writer, fmt.Sprintf(formatter, val)))
 	}
 	_, err = io.WriteString(a.w, out)
 	a.previousOutputEndedInNewline = false
 	return
 }
 
+// wrapError returns the Go expression for the error in errVar, wrapped with the location in the template of item,
+// so that the caller of the template knows where the error came from.
+func (a *astWalker) wrapError(item tokenItem, errVar string) string {
+	ref, ok := item.sourceLocation()
+	if !ok {
+		return errVar
+	}
+	a.c.addImport("github.com/goradd/got/gotrt")
+	return fmt.Sprintf("gotrt.WrapError(%s, %s, %d)", errVar, strconv.Quote(filepath.Base(ref.fileName)), ref.lineNum+1)
+}
+
+// contextWriter returns the writer and formatter that output the value of item escaped for the current HTML context,
+// and moves the context past the value.
+func (a *astWalker) contextWriter(item tokenItem, formatter string) (writer string, expr string) {
+	escapers, jsValue := a.ctx.escapers()
+	if jsValue {
+		switch item.typ {
+		case itemString, itemBool, itemInt, itemUInt, itemFloat, itemInterface, itemBytes:
+			// let the escaper output the value as a JavaScript value of the same type
+			formatter = `%s`
+		}
+	}
+	if item.typ == itemGoType {
+		formatter = `func()string {a,b,f := strings.Cut(` + formatter + `, "."); if f {return b} else {return a}}()`
+	}
+	expr = formatter
+	for _, e := range escapers {
+		expr = "gotrt." + e + "(" + expr + ")"
+	}
+
+	writer = `io.WriteString(_w, %s)`
+	if item.htmlBreaks && a.ctx.state == stateText {
+		writer = `io.WriteString(_w, strings.Replace(%s, "\n", "<br>\n", -1))`
+	}
+	a.ctx = a.ctx.afterValue()
+	return
+}
+
+// checkContext returns an error if contextual escaping is on and the contexts c1 and c2 are different.
+// Output that can take more than one path through a template must end in the same context on every path,
+// so that the values that follow can be escaped correctly. The message is formatted with the descriptions of the contexts.
+func (a *astWalker) checkContext(item tokenItem, c1, c2 htmlContext, message string) error {
+	if !a.c.autoEscape || c1 == c2 {
+		return nil
+	}
+	return newTemplateError(tokenItem{typ: itemError, val: fmt.Sprintf(message, c1, c2), callStack: item.callStack})
+}
+
+// outputMessage outputs the message of a msg tag, translated by the message translator, with the values of its parameters put in it.
+// The translated message is output like a string value, so it is escaped the same way.
+func (a *astWalker) outputMessage(item tokenItem) error {
+	var b strings.Builder
+	b.WriteString("gotrt.Message{")
+	if id, ok := item.params["id"]; ok {
+		b.WriteString("ID: " + strconv.Quote(id.val) + ", ")
+	}
+	if context, ok := item.params["context"]; ok {
+		b.WriteString("Context: " + strconv.Quote(context.val) + ", ")
+	}
+	b.WriteString("Text: " + quoteText(item.params["text"].val))
+	if plural, ok := item.params["plural"]; ok {
+		b.WriteString(", Plural: " + quoteText(plural.val))
+	}
+	if count, ok := item.params["count"]; ok {
+		b.WriteString(", Count: int(" + count.val + ")")
+	}
+	if len(item.childItems) > 0 {
+		b.WriteString(", Args: []gotrt.Arg{")
+		for _, arg := range item.childItems {
+			name, value, _ := strings.Cut(arg.val, "=")
+			b.WriteString("{Name: " + strconv.Quote(name) + ", Value: " + value + "}, ")
+		}
+		b.WriteString("}")
+	}
+	b.WriteString("}")
+
+	if a.c.catalog != nil {
+		a.c.catalog.addItem(item, catalogEntry{
+			ID:      item.params["id"].val,
+			Context: item.params["context"].val,
+			Text:    item.params["text"].val,
+			Plural:  item.params["plural"].val,
+		})
+	}
+
+	translator := "gotrt.Messages"
+	if a.c.translator != "" {
+		translator = "(" + a.c.translator + ")"
+	}
+	a.c.addImport("github.com/goradd/got/gotrt")
+
+	value := item
+	value.typ = itemString
+	value.val = translator + ".TranslateMessage(" + b.String() + ")"
+	return a.outputValue(value)
+}
+
 func (a *astWalker) outputGoErr(item tokenItem) (err error) {
-	_, err = fmt.Fprintf(a.w, "\nif err = %s; err != nil {return}\n", item.val)
+	_, err = fmt.Fprintf(a.w, "\nif err = %s%s; err != nil {return %s}\n", a.lineDirective(item), item.val, a.wrapError(item, "err"))
 	return
 }
 
@@ -270,12 +494,16 @@ func quoteText(val string) string {
 }
 
 func (a *astWalker) outputIf(topItem tokenItem) (err error) {
-	for _, ifItem := range topItem.childItems {
+	start := a.ctx
+	end := start
+	hasElse := false
+	for i, ifItem := range topItem.childItems {
+		a.ctx = start
 		switch ifItem.typ {
 		case itemIf:
-			_, err = fmt.Fprintf(a.w, "\nif %s {\n", ifItem.val)
+			_, err = fmt.Fprintf(a.w, "\nif %s%s {\n", a.lineDirective(ifItem), ifItem.val)
 		case itemElseIf:
-			_, err = fmt.Fprintf(a.w, "\n} else if %s {\n", ifItem.val)
+			_, err = fmt.Fprintf(a.w, "\n} else if %s%s {\n", a.lineDirective(ifItem), ifItem.val)
 		case itemElse:
 			_, err = fmt.Fprintf(a.w, "\n} else {\n")
 		}
@@ -288,7 +516,19 @@ func (a *astWalker) outputIf(topItem tokenItem) (err error) {
 		if err = a.walkItems(ifItem.childItems); err != nil {
 			return err
 		}
+		if i == 0 {
+			end = a.ctx
+		} else if err = a.checkContext(ifItem, end, a.ctx, "the branches of an if statement end in different contexts, %s and %s"); err != nil {
+			return err
+		}
+		hasElse = hasElse || ifItem.typ == itemElse
 	}
+	if !hasElse {
+		if err = a.checkContext(topItem.childItems[0], end, start, "an if statement without an else must end in the context it starts in, but it ends in %s instead of %s"); err != nil {
+			return err
+		}
+	}
+	a.ctx = end
 	if _, err = fmt.Fprintf(a.w, "\n}\n"); err != nil {
 		return err
 	}
@@ -296,12 +536,191 @@ func (a *astWalker) outputIf(topItem tokenItem) (err error) {
 }
 
 func (a *astWalker) outputFor(item tokenItem) (err error) {
-	_, err = fmt.Fprintf(a.w, "\nfor %s {\n", item.val)
+	_, hasEmpty := item.params["empty"]
+	index, first, last := loopMetaUsed(item.childItems, false)
+	counted := hasEmpty || index || first || last
+	condition := item.val
+
+	if counted {
+		if _, err = io.WriteString(a.w, "\n{\n"); err != nil {
+			return err
+		}
+		if last {
+			if prefix, collection, ok := splitRange(condition); ok {
+				// evaluate the range expression only once, and use its length to find the last item
+				if _, err = fmt.Fprintf(a.w, "_c := %s%s\n_n := len(_c)\n", a.lineDirective(item), collection); err != nil {
+					return err
+				}
+				condition = prefix + "range _c"
+			} else {
+				return newTemplateError(tokenItem{typ: itemError, val: "_last can only be used in a for loop that ranges over a collection, like for _, v := range items", callStack: item.callStack})
+			}
+		}
+		if _, err = io.WriteString(a.w, "_index := -1\n"); err != nil {
+			return err
+		}
+	}
+
+	if _, err = fmt.Fprintf(a.w, "\nfor %s%s {\n", a.lineDirective(item), condition); err != nil {
+		return err
+	}
+	if counted {
+		if err = a.outputLoopMeta(first, last); err != nil {
+			return err
+		}
+	}
 	defer a.setTextMode(a.textMode, a.escapeText, a.htmlBreaks, a.translate)
 	a.setTextMode(true, false, false, false)
+	start := a.ctx
 	if err = a.walkItems(item.childItems); err != nil {
 		return err
 	}
+	if err = a.checkContext(item, a.ctx, start, "a for loop must end in the context it starts in, but it ends in %s instead of %s"); err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(a.w, "\n}\n"); err != nil {
+		return err
+	}
+	if counted {
+		return a.outputLoopEnd(item)
+	}
+	return
+}
+
+// loopMetaRegex finds the loop metadata variables that can be used inside for and join loops.
+var loopMetaRegex = regexp.MustCompile(`\b_(index|first|last)\b`)
+
+// loopMetaUsed returns which of the loop metadata variables are used by the given items, which
+// are the contents of a loop. goCode is true if runs in the items are go code rather than text.
+// The contents of nested loops are not searched, since those loops have their own metadata.
+func loopMetaUsed(items []tokenItem, goCode bool) (index, first, last bool) {
+	for _, item := range items {
+		if item.typ != itemRun || goCode {
+			for _, m := range loopMetaRegex.FindAllStringSubmatch(item.val, -1) {
+				switch m[1] {
+				case "index":
+					index = true
+				case "first":
+					first = true
+				case "last":
+					last = true
+				}
+			}
+		}
+
+		// the parameters of a nested loop, including its empty section, are outside of the nested loop
+		var params []tokenItem
+		for _, p := range item.params {
+			params = append(params, p)
+		}
+		i, f, l := loopMetaUsed(params, goCode)
+		index, first, last = index || i, first || f, last || l
+
+		if item.typ == itemFor || item.typ == itemJoin {
+			continue
+		}
+		childGoCode := goCode
+		switch item.typ {
+		case itemGo:
+			childGoCode = true
+		case itemText, itemEmpty, itemCase, itemDefault, itemIf, itemElseIf, itemElse:
+			childGoCode = false
+		}
+		i, f, l = loopMetaUsed(item.childItems, childGoCode)
+		index, first, last = index || i, first || f, last || l
+	}
+	return
+}
+
+// splitRange splits a for condition that has a range clause into the part before the range expression, and the range expression.
+func splitRange(condition string) (prefix string, collection string, ok bool) {
+	loc := rangeRegex.FindStringSubmatchIndex(condition)
+	if loc == nil {
+		return
+	}
+	return condition[:loc[2]], strings.TrimSpace(condition[loc[3]:]), true
+}
+
+var rangeRegex = regexp.MustCompile(`(?:^|\s|=)(range)\s`)
+
+// outputLoopMeta outputs the code at the start of a loop body that keeps track of the loop metadata.
+// The _index variable counts the times through the loop, and is also used to tell whether the loop ran.
+func (a *astWalker) outputLoopMeta(first, last bool) (err error) {
+	if _, err = io.WriteString(a.w, "_index++\n"); err != nil {
+		return err
+	}
+	if first {
+		if _, err = io.WriteString(a.w, "_first := _index == 0\n"); err != nil {
+			return err
+		}
+	}
+	if last {
+		if _, err = io.WriteString(a.w, "_last := _index == _n-1\n"); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// outputLoopEnd outputs the empty section of a loop, if it has one, to run if the loop did not, and closes the
+// scope that holds the loop metadata.
+func (a *astWalker) outputLoopEnd(item tokenItem) (err error) {
+	if emptyItem, ok := item.params["empty"]; ok {
+		if _, err = io.WriteString(a.w, "\nif _index < 0 {\n"); err != nil {
+			return err
+		}
+		defer a.setTextMode(a.textMode, a.escapeText, a.htmlBreaks, a.translate)
+		a.setTextMode(true, false, false, false)
+		start := a.ctx
+		if err = a.walkItems(emptyItem.childItems); err != nil {
+			return err
+		}
+		if err = a.checkContext(emptyItem, a.ctx, start, "the empty section of a loop must end in the context the loop starts in, but it ends in %s instead of %s"); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(a.w, "\n}\n"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(a.w, "}\n")
+	return
+}
+
+func (a *astWalker) outputSwitch(item tokenItem) (err error) {
+	if _, err = fmt.Fprintf(a.w, "\nswitch %s%s {\n", a.lineDirective(item), item.val); err != nil {
+		return err
+	}
+	defer a.setTextMode(a.textMode, a.escapeText, a.htmlBreaks, a.translate)
+	a.setTextMode(true, false, false, false)
+	start := a.ctx
+	end := start
+	hasDefault := false
+	for i, caseItem := range item.childItems {
+		a.ctx = start
+		if caseItem.typ == itemDefault {
+			_, err = fmt.Fprintf(a.w, "\ndefault:\n")
+		} else {
+			_, err = fmt.Fprintf(a.w, "\ncase %s%s:\n", a.lineDirective(caseItem), caseItem.val)
+		}
+		if err != nil {
+			return err
+		}
+		if err = a.walkItems(caseItem.childItems); err != nil {
+			return err
+		}
+		if i == 0 {
+			end = a.ctx
+		} else if err = a.checkContext(caseItem, end, a.ctx, "the cases of a switch statement end in different contexts, %s and %s"); err != nil {
+			return err
+		}
+		hasDefault = hasDefault || caseItem.typ == itemDefault
+	}
+	if !hasDefault {
+		if err = a.checkContext(item, end, start, "a switch statement without a default must end in the context it starts in, but it ends in %s instead of %s"); err != nil {
+			return err
+		}
+	}
+	a.ctx = end
 	if _, err = fmt.Fprintf(a.w, "\n}\n"); err != nil {
 		return err
 	}
@@ -309,21 +728,87 @@ func (a *astWalker) outputFor(item tokenItem) (err error) {
 }
 
 func (a *astWalker) outputJoin(item tokenItem) (err error) {
-	_, err = fmt.Fprintf(a.w, `
-for _i,_j := range %s {
-	_ = _j
-`, item.params["slice"].val)
+	// the index is always counted, since it is used to decide when to output the join string
+	_, first, last := loopMetaUsed(item.childItems, false)
+	_, sorted := item.params["sorted"]
+	collection := item.params["slice"]
+	key := item.params["key"].val
+	value := item.params["value"].val
+
+	if _, err = io.WriteString(a.w, "\n{\n"); err != nil {
+		return err
+	}
+	rangeExpr := a.lineDirective(collection) + collection.val
+	if sorted || last {
+		// evaluate the collection only once
+		if _, err = fmt.Fprintf(a.w, "_c := %s\n", rangeExpr); err != nil {
+			return err
+		}
+		rangeExpr = "_c"
+		if last {
+			if _, err = io.WriteString(a.w, "_n := len(_c)\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err = io.WriteString(a.w, "_index := -1\n"); err != nil {
+		return err
+	}
+
+	a.c.addImport("io")
+	if sorted {
+		a.c.addImport("maps")
+		a.c.addImport("slices")
+		if key == "_" && (value == "" || value == "_") {
+			// neither the key nor the value is used
+			_, err = io.WriteString(a.w, "for range slices.Sorted(maps.Keys(_c)) {\n")
+		} else {
+			if key == "_" {
+				key = "_k"
+			}
+			_, err = fmt.Fprintf(a.w, "for _, %s := range slices.Sorted(maps.Keys(_c)) {\n", key)
+			if err == nil && value != "" && value != "_" {
+				_, err = fmt.Fprintf(a.w, "%s := _c[%s]\n", value, key)
+			}
+		}
+	} else {
+		vars := key
+		if value != "" {
+			vars += ", " + value
+		}
+		_, err = fmt.Fprintf(a.w, "for %s := range %s {\n", vars, rangeExpr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = a.outputLoopMeta(first, last); err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(a.w, "if _index > 0 {\n\tif _, err = io.WriteString(_w, %q); err != nil {return}\n}\n", item.params["joinString"].val); err != nil {
+		return err
+	}
+	if _, ok := item.params["implicitVars"]; ok {
+		if _, err = fmt.Fprintf(a.w, "_, _ = %s, %s\n", key, value); err != nil {
+			return err
+		}
+	}
 	{
 		defer a.setTextMode(a.textMode, a.escapeText, a.htmlBreaks, a.translate)
 		a.setTextMode(true, false, false, false)
+		start := a.ctx
+		if err = a.checkContext(item, start.advance(item.params["joinString"].val), start, "the separator of a join statement must not change the context, but it changes it to %s from %s"); err != nil {
+			return err
+		}
 		if err = a.walkItems(item.childItems); err != nil {
 			return err
 		}
+		if err = a.checkContext(item, a.ctx, start, "a join statement must end in the context it starts in, but it ends in %s instead of %s"); err != nil {
+			return err
+		}
 	}
-	_, err = fmt.Fprintf(a.w, `
-	if _i < len(%s) - 1 {
-		if _, err = io.WriteString(_w, %q); err != nil {return}
+	if _, err = io.WriteString(a.w, "\n}\n"); err != nil {
+		return err
 	}
-}`, item.params["slice"].val, item.params["joinString"].val)
-	return
+	return a.outputLoopEnd(item)
 }
@@ -0,0 +1,180 @@
+package got
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// CompileOptions are the options used by Compile.
+type CompileOptions struct {
+	// FileName is the name of the template being compiled. It is used when reporting errors,
+	// to find include files that are relative to the template, and to fill in the template* named blocks.
+	FileName string
+	// OutPath is the path the generated code will be written to. It is only used to fill in the out* named blocks.
+	OutPath string
+	// IncludePaths are the directories to search for include files, in the order given.
+	IncludePaths []string
+	// IncludeFiles are files that are processed and prepended to the template.
+	IncludeFiles []string
+	// LineDirectives adds line directives to the generated code that map it back to the template.
+	LineDirectives bool
+	// MaxErrors is the number of errors to report before giving up. Zero means the default of 10,
+	// and a negative number means there is no limit.
+	MaxErrors int
+	// MaxExpansionDepth is how deeply named blocks and include files may be nested inside each other.
+	// Zero means the default of 100, and a negative number means there is no limit. Blocks and files that
+	// expand themselves are always reported.
+	MaxExpansionDepth int
+	// AutoEscape escapes every value to suit where it lands in the surrounding HTML, like html/template does.
+	// The generated code calls the escaping functions in the gotrt package.
+	AutoEscape bool
+	// EscapeByDefault html escapes string, byte slice and Stringer values without the ! prefix on the tag, as if
+	// the template started with an {{escape on}} tag. Values can still be output as is with the raw tag.
+	EscapeByDefault bool
+	// Translator is the Go expression for the gotrt.MessageTranslator that msg tags translate their messages with.
+	// If it is empty, they use gotrt.Messages.
+	Translator string
+	// TextTranslator is the Go expression for the gotrt.Translator that translate tags translate their text with.
+	// If it is empty, they use gotrt.Texts.
+	TextTranslator string
+}
+
+// compilation holds the state used while compiling one template. Each template gets its own
+// compilation, so that multiple templates can be compiled at the same time without interfering with each other.
+type compilation struct {
+	// modules maps module names to directories, and is used to turn module paths into file paths.
+	modules map[string]string
+	// includePaths are the directories that are searched to find include files.
+	includePaths []string
+	// includeNamedBlocks are the named blocks defined by files that are prepended to the template.
+	includeNamedBlocks map[string]namedBlockEntry
+
+	// dependencies are the files, other than the template itself, that were read to produce the output.
+	// Include files are lexed in their own goroutines, so access is guarded by dependencyMutex.
+	dependencies    map[string]struct{}
+	dependencyMutex sync.Mutex
+
+	// lineDirectives turns on the output of line directives that point back to the template.
+	lineDirectives bool
+	// lineDirectiveDir is the directory of the generated file. File names in line directives are made relative to it.
+	lineDirectiveDir string
+	// maxErrors is the number of errors to report for a file before giving up. See CompileOptions.MaxErrors.
+	maxErrors int
+	// maxExpansionDepth limits how deeply blocks and files may be nested. See CompileOptions.MaxExpansionDepth.
+	maxExpansionDepth int
+	// autoEscape turns on contextual escaping of values. See CompileOptions.AutoEscape.
+	autoEscape bool
+	// escapeByDefault html escapes values that do not have the ! prefix. See CompileOptions.EscapeByDefault.
+	escapeByDefault bool
+	// translator is the Go expression for the translator of msg tags. See CompileOptions.Translator.
+	translator string
+	// textTranslator is the Go expression for the translator of translate tags. See CompileOptions.TextTranslator.
+	textTranslator string
+
+	// catalog collects the messages to translate while the asts are walked, when extracting them.
+	catalog *catalog
+
+	// imports are the import paths of the packages that the generated code calls into.
+	imports map[string]struct{}
+
+	// sourceItems are the items that line directives point to while code is generated again to locate syntax errors.
+	// Line directives point to these items instead of template files when it is not nil. See sourceError.
+	sourceItems []tokenItem
+}
+
+func newCompilation(modules map[string]string) *compilation {
+	return &compilation{
+		modules:            modules,
+		includeNamedBlocks: make(map[string]namedBlockEntry),
+		dependencies:       make(map[string]struct{}),
+	}
+}
+
+// addDependency records that the output depends on the given file.
+func (c *compilation) addDependency(path string) {
+	path, _ = filepath.Abs(path)
+	c.dependencyMutex.Lock()
+	c.dependencies[path] = struct{}{}
+	c.dependencyMutex.Unlock()
+}
+
+// dependencyList returns the absolute paths of the files the output depends on, sorted.
+func (c *compilation) dependencyList() (deps []string) {
+	c.dependencyMutex.Lock()
+	for d := range c.dependencies {
+		deps = append(deps, d)
+	}
+	c.dependencyMutex.Unlock()
+	sort.Strings(deps)
+	return
+}
+
+// realPath converts a path that may start with a module name to a file system path.
+func (c *compilation) realPath(path string) string {
+	return realPath(path, c.modules)
+}
+
+// Compile processes the GoT template read from src and returns the generated Go code.
+//
+// Compile does not write any files, but it will read any include files that the template refers to.
+// Separate calls to Compile do not share any state, and may run concurrently.
+func Compile(src io.Reader, opts CompileOptions) ([]byte, error) {
+	c := newCompilation(nil)
+	c.lineDirectives = opts.LineDirectives
+	c.maxErrors = opts.MaxErrors
+	c.maxExpansionDepth = opts.MaxExpansionDepth
+	c.autoEscape = opts.AutoEscape
+	c.escapeByDefault = opts.EscapeByDefault
+	c.translator = opts.Translator
+	c.textTranslator = opts.TextTranslator
+
+	fileName := opts.FileName
+	if fileName != "" {
+		fileName, _ = filepath.Abs(fileName)
+	}
+	outPath := opts.OutPath
+	if outPath != "" {
+		outPath, _ = filepath.Abs(outPath)
+		c.lineDirectiveDir = filepath.Dir(outPath)
+	}
+
+	for _, p := range opts.IncludePaths {
+		p, _ = filepath.Abs(p)
+		c.includePaths = append(c.includePaths, p)
+	}
+	if fileName != "" {
+		c.includePaths = append(c.includePaths, filepath.Dir(fileName))
+	} else if cwd, err := os.Getwd(); err == nil {
+		c.includePaths = append(c.includePaths, cwd)
+	}
+
+	var includeFiles []string
+	for _, f := range opts.IncludeFiles {
+		f, _ = filepath.Abs(f)
+		includeFiles = append(includeFiles, f)
+	}
+	asts, err := c.prepIncludeFiles(includeFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := c.buildAstFromReader(fileName, src, c.templateNamedBlocks(fileName, outPath))
+	if err != nil {
+		return nil, err
+	}
+	asts = append(asts, a)
+
+	var buf bytes.Buffer
+	if err = c.writeAsts(&buf, "", asts...); err != nil {
+		if te, ok := err.(*TemplateError); ok {
+			return nil, te
+		}
+		return nil, fmt.Errorf("could not write generated code: %s", err.Error())
+	}
+	return c.finishSource(buf.Bytes(), asts)
+}
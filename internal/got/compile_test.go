@@ -0,0 +1,468 @@
+package got
+
+import (
+	"fmt"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileConcurrent(t *testing.T) {
+	srcPath := filepath.Join("..", "testdata", "src")
+	tests := []struct {
+		includePath string
+		want        string
+	}{
+		{filepath.Join(srcPath, "inc"), "`wrong`"},
+		{filepath.Join(srcPath, "inc2"), "`right`"},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		tt := tests[i%len(tests)]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			src := fmt.Sprintf("{{define b%d}}%d{{end b%[1]d}}{{ {{: \"incSub/incSub.inc\" }}{{b%[1]d}} }}", i, i)
+			out, err := Compile(strings.NewReader(src), CompileOptions{IncludePaths: []string{tt.includePath}})
+			if assert.NoError(t, err) {
+				assert.Contains(t, string(out), tt.want)
+				assert.Contains(t, string(out), fmt.Sprintf("`%d`", i))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCompileLineDirectives(t *testing.T) {
+	src := `package a
+
+func A(_w io.Writer, items []string) (err error) {
+{{
+Hello {{= items[0] }}
+{{for _, s := range items }}{{s s }}{{for}}
+}}
+{{g
+	x := 1
+	_ = x
+}}
+	return
+}
+`
+	dir := t.TempDir()
+	opts := CompileOptions{
+		FileName:       filepath.Join(dir, "tpl", "a.tpl.got"),
+		OutPath:        filepath.Join(dir, "a.tpl.go"),
+		LineDirectives: true,
+	}
+	out, err := Compile(strings.NewReader(src), opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(out), "/*line tpl/a.tpl.got:")
+
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, opts.OutPath, out, 0)
+	if !assert.NoError(t, err, string(out)) {
+		return
+	}
+	lines := make(map[string][]int)
+	goast.Inspect(f, func(n goast.Node) bool {
+		if id, ok := n.(*goast.Ident); ok {
+			pos := fset.Position(id.Pos())
+			assert.Equal(t, opts.FileName, pos.Filename, id.Name)
+			lines[id.Name] = append(lines[id.Name], pos.Line)
+		}
+		return true
+	})
+	assert.Equal(t, []int{3, 5, 6}, lines["items"])
+	assert.Equal(t, []int{6, 6}, lines["s"])
+	assert.Equal(t, []int{9, 10}, lines["x"])
+
+	// line directives are off by default
+	opts.LineDirectives = false
+	out, err = Compile(strings.NewReader(src), opts)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "/*line")
+}
+
+func TestCompileRecursion(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "self.inc"), []byte(`{{: "self.inc" }}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.inc"), []byte(`{{: "b.inc" }}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.inc"), []byte(`{{define c}}{{: "a.inc" }}{{end c}}{{c}}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "text.inc"), []byte(`{{ {{:! "text.inc" }} }}`), 0644))
+
+	tests := []struct {
+		name     string
+		src      string
+		maxDepth int
+		wantErr  string
+	}{
+		{"self block", `{{define a}}{{a}}{{end a}}{{a}}`, 0, "infinite recursion: block a -> block a"},
+		{"indirect block", `{{define x}}{{y}}{{end x}}{{define y}}{{x}}{{end y}}{{x}}`, 0, "infinite recursion: block x -> block y -> block x"},
+		{"self include", `{{: "self.inc" }}`, 0, "infinite recursion: file " + filepath.Join(dir, "self.inc") + " -> file " + filepath.Join(dir, "self.inc")},
+		{"include and block", `{{: "a.inc" }}`, 0, "-> block c -> file " + filepath.Join(dir, "a.inc")},
+		{"self include as text", `{{: "text.inc" }}`, 0, ""},
+		{"depth", `{{define x}}1{{end x}}{{define y}}{{x}}{{end y}}{{define z}}{{y}}{{end z}}{{z}}`, 2, "nested more than 2 deep: file " + filepath.Join(dir, "t.got") + " -> block z -> block y -> block x"},
+		{"depth ok", `{{define x}}1{{end x}}{{define y}}{{x}}{{end y}}{{define z}}{{y}}{{end z}}{{z}}`, 3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := CompileOptions{FileName: filepath.Join(dir, "t.got"), MaxExpansionDepth: tt.maxDepth}
+			_, err := Compile(strings.NewReader(tt.src), opts)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileAutoEscape(t *testing.T) {
+	src := `package a
+
+func A(_w io.Writer, s string, n int, u string) (err error) {
+{{
+<p title="{{s s }}">{{!s s }}</p>
+<a href="{{= u }}?q={{s s }}">{{i n }}</a>
+<script>var a = {{s s }}, b = {{i n }}, c = "{{s s }}";</script>
+<div style="color: {{s s }}">{{!h s }}</div>
+{{if n > 0}}<b>{{s s }}</b>{{else}}{{s s }}{{if}}
+{{for i := range n}}<i>{{i i }}</i>{{for}}
+}}
+	return
+}
+`
+	out, err := Compile(strings.NewReader(src), CompileOptions{AutoEscape: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	code := string(out)
+	_, err = goparser.ParseFile(token.NewFileSet(), "a.go", out, 0)
+	assert.NoError(t, err, code)
+
+	assert.Contains(t, code, "io.WriteString(_w, gotrt.EscapeAttr(s))")
+	assert.Contains(t, code, "io.WriteString(_w, gotrt.EscapeHTML(s))")
+	assert.Contains(t, code, "gotrt.EscapeAttr(gotrt.EscapeURL(u))")
+	assert.Contains(t, code, "gotrt.EscapeAttr(gotrt.EscapeURLQuery(s))")
+	assert.Contains(t, code, "gotrt.EscapeHTML(strconv.Itoa(n))")
+	assert.Contains(t, code, "gotrt.EscapeJS(s)")
+	assert.Contains(t, code, "gotrt.EscapeJS(n)")
+	assert.Contains(t, code, "gotrt.EscapeJSString(s)")
+	assert.Contains(t, code, "gotrt.EscapeAttr(gotrt.EscapeCSS(s))")
+	assert.Contains(t, code, `strings.Replace(gotrt.EscapeHTML(s), "\n", "<br>\n", -1)`)
+	assert.Contains(t, code, "gotrt.EscapeHTML(strconv.Itoa(i))")
+	assert.NotContains(t, code, "html.EscapeString")
+
+	// without the option, values are output as before
+	out, err = Compile(strings.NewReader(src), CompileOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "gotrt")
+}
+
+func TestCompileAutoEscapeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		wantErr string
+	}{
+		{"if", `{{ {{if a}}<a href="{{else}}<b>{{if}}{{s b}} }}`, "the branches of an if statement end in different contexts, a URL attribute value and HTML text"},
+		{"if without else", `{{ {{if a}}<a {{if}}{{s b}} }}`, "an if statement without an else must end in the context it starts in, but it ends in a tag instead of HTML text"},
+		{"switch", "{{ {{switch a}}{{case 1}}<script>{{case 2}}{{switch}} }}", "the cases of a switch statement end in different contexts, a script element and HTML text"},
+		{"switch without default", "{{ {{switch a}}{{case 1}}<!-- {{switch}} }}", "a switch statement without a default must end in the context it starts in, but it ends in an HTML comment instead of HTML text"},
+		{"for", `{{ {{for _, b := range a}}<p title="{{s b}}{{for}} }}`, "a for loop must end in the context it starts in, but it ends in an attribute value instead of HTML text"},
+		{"empty", `{{ {{for _, b := range a}}{{s b}}{{empty}}<textarea>{{for}} }}`, "the empty section of a loop must end in the context the loop starts in, but it ends in a textarea element instead of HTML text"},
+		{"join", `{{ {{join a, "<p"}}{{s _j}}{{join}} }}`, "the separator of a join statement must not change the context, but it changes it to a tag from HTML text"},
+		{"same contexts", `{{ {{if a}}<a href="x">{{else}}<b>{{if}}{{for _, b := range a}}<i>{{s b}}</i>{{empty}}none{{for}} }}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile(strings.NewReader(tt.src), CompileOptions{AutoEscape: true})
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+				if assert.Len(t, Diagnostics(err), 1) {
+					assert.NotNil(t, Diagnostics(err)[0].Location)
+				}
+			}
+			// the same template is fine without contextual escaping
+			_, err = Compile(strings.NewReader(tt.src), CompileOptions{})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCompileEscapeByDefault(t *testing.T) {
+	src := "{{ {{= a }}{{raw b }} }}"
+	out, err := Compile(strings.NewReader(src), CompileOptions{EscapeByDefault: true})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "html.EscapeString(a)")
+		assert.Contains(t, string(out), "io.WriteString(_w, b)")
+	}
+
+	// raw values are not escaped by contextual escaping either
+	out, err = Compile(strings.NewReader(`{{ <a href="{{= a }}">{{raw b }}</a> }}`), CompileOptions{AutoEscape: true})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "gotrt.EscapeAttr(gotrt.EscapeURL(a))")
+		assert.Contains(t, string(out), "io.WriteString(_w, b)")
+	}
+}
+
+func TestCompileImports(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"no imports", "package a\n\nfunc A(_w io.Writer, n int) (err error) {\n{{ {{i n }} }}\nreturn\n}\n",
+			[]string{`"io"`, `"strconv"`}},
+		{"merged", "package a\n\nimport (\n\t\"io\"\n)\n\nfunc A(_w io.Writer, n int, v any) (err error) {\n{{ {{!= \"a\" }}{{v}}{{i n }} }}\nreturn\n}\n",
+			[]string{`"io"`, `"fmt"`, `"html"`, `"strconv"`}},
+		{"single import", "package a\n\nimport \"io\"\n\nfunc A(_w io.Writer, m map[string]int) (err error) {\n{{ {{join v, k in m, \",\", sorted}}{{s k}}{{i v}}{{join}} }}\nreturn\n}\n",
+			[]string{`"io"`, `"maps"`, `"slices"`, `"strconv"`}},
+		{"renamed", "package a\n\nimport h \"html\"\n\nvar _ = h.EscapeString\n\nfunc A(_w io.Writer) (err error) {\n{{ {{!= \"a\" }} }}\nreturn\n}\n",
+			[]string{`h "html"`, `"html"`, `"io"`}},
+		{"contextual", "package a\n\nfunc A(_w io.Writer) (err error) {\n{{ <a href=\"{{= \"x\" }}\"> }}\nreturn\n}\n",
+			[]string{`"github.com/goradd/got/gotrt"`, `"io"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Compile(strings.NewReader(tt.src), CompileOptions{AutoEscape: tt.name == "contextual"})
+			if !assert.NoError(t, err) {
+				return
+			}
+			f, err := goparser.ParseFile(token.NewFileSet(), "a.go", out, goparser.ImportsOnly)
+			if !assert.NoError(t, err, string(out)) {
+				return
+			}
+			var imports []string
+			for _, spec := range f.Imports {
+				if spec.Name != nil {
+					imports = append(imports, spec.Name.Name+" "+spec.Path.Value)
+				} else {
+					imports = append(imports, spec.Path.Value)
+				}
+			}
+			assert.ElementsMatch(t, tt.want, imports)
+			assert.NotContains(t, string(out), "\n\n\n", "output is formatted")
+		})
+	}
+
+	// output that is not a complete Go file is left as is
+	out, err := Compile(strings.NewReader("{{ {{i n }} }}"), CompileOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "import")
+}
+
+func TestCompileSyntaxError(t *testing.T) {
+	src := `package a
+
+func A(_w io.Writer) (err error) {
+{{ Hello }}
+{{g x := }}
+	return
+}
+`
+	dir := t.TempDir()
+	for _, lineDirectives := range []bool{false, true} {
+		opts := CompileOptions{FileName: filepath.Join(dir, "a.tpl.got"), OutPath: filepath.Join(dir, "a.tpl.go"), LineDirectives: lineDirectives}
+		out, err := Compile(strings.NewReader(src), opts)
+		assert.Nil(t, out)
+		if assert.Error(t, err) {
+			diags := Diagnostics(err)
+			if assert.NotEmpty(t, diags) && assert.NotNil(t, diags[0].Location) {
+				assert.Equal(t, opts.FileName, diags[0].Location.File)
+				assert.Equal(t, 6, diags[0].Location.Line)
+				assert.Contains(t, diags[0].Message, "generated Go code does not parse")
+			}
+		}
+	}
+
+	// without a template file, the line in the template is still given
+	_, err := Compile(strings.NewReader(src), CompileOptions{})
+	if diags := Diagnostics(err); assert.Len(t, diags, 2) && assert.NotNil(t, diags[0].Location) {
+		assert.Equal(t, 6, diags[0].Location.Line)
+	}
+
+	// an error in a named block is located in the block, and reached from where the block is used
+	src = `package a
+
+{{define bad}}
+{{g x := ) }}
+{{end bad}}
+func A(_w io.Writer) (err error) {
+{{bad}}
+	return
+}
+`
+	opts := CompileOptions{FileName: filepath.Join(dir, "b.tpl.got")}
+	_, err = Compile(strings.NewReader(src), opts)
+	diags := Diagnostics(err)
+	if assert.NotEmpty(t, diags) && assert.NotNil(t, diags[0].Location) {
+		assert.Equal(t, Location{File: opts.FileName, Line: 4, Column: 10}, *diags[0].Location)
+		if assert.Len(t, diags[0].CallStack, 3) {
+			assert.Equal(t, "bad", diags[0].CallStack[0].Block)
+			assert.Equal(t, 7, diags[0].CallStack[2].Line)
+		}
+	}
+}
+
+func TestCompileFragment(t *testing.T) {
+	// a list of statements is formatted
+	out, err := Compile(strings.NewReader("{{g  x  :=  1 }}\n{{g _ =   x}}"), CompileOptions{})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "\nx := 1\n_ = x")
+	}
+
+	// a fragment that is not valid on its own is left as is
+	out, err = Compile(strings.NewReader("{{g  if  x {}}"), CompileOptions{})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "\n if  x {")
+	}
+}
+
+func TestCompileValueError(t *testing.T) {
+	dir := t.TempDir()
+	src := "package a\n\nfunc A(_w io.Writer) (err error) {\n{{\n{{se f() }}\n}}\n\treturn\n}\n"
+	out, err := Compile(strings.NewReader(src), CompileOptions{FileName: filepath.Join(dir, "a.tpl.got")})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), `return gotrt.WrapError(_err2, "a.tpl.got", 5)`)
+		assert.Contains(t, string(out), `"github.com/goradd/got/gotrt"`)
+	}
+
+	// without a template file, the error is returned as is
+	out, err = Compile(strings.NewReader(src), CompileOptions{})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "return _err2")
+	}
+}
+
+func TestCompileLoops(t *testing.T) {
+	// a sorted join that uses neither the key nor the value does not declare them
+	out, err := Compile(strings.NewReader(`{{join _ in m, ",", sorted}}x{{join}}`), CompileOptions{})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(out), "for range slices.Sorted(maps.Keys(_c)) {")
+		assert.NotContains(t, string(out), "_k")
+	}
+
+	// _last needs a collection to find the length of
+	opts := CompileOptions{FileName: filepath.Join(t.TempDir(), "a.tpl.got")}
+	_, err = Compile(strings.NewReader("{{\n{{for i := 0; i < 3; i++}}{{if _last}}last{{if}}{{for}}\n}}"), opts)
+	if diags := Diagnostics(err); assert.Len(t, diags, 1) && assert.NotNil(t, diags[0].Location) {
+		assert.Contains(t, diags[0].Message, "_last can only be used in a for loop that ranges over a collection")
+		assert.Equal(t, 2, diags[0].Location.Line)
+	}
+}
+
+func TestCompileSlots(t *testing.T) {
+	dir := t.TempDir()
+	opts := CompileOptions{FileName: filepath.Join(dir, "t.tpl.got")}
+
+	// a call of a block can be nested in the content of a call of the same block
+	src := `{{define box}}[{{slot}}]{{end box}}{{call box}}{{call box}}a{{call}}{{call}}`
+	_, err := Compile(strings.NewReader(src), opts)
+	assert.NoError(t, err)
+
+	// an error in the content of a slot is located where the content was written
+	src = `{{define box}}
+[{{slot}}]
+{{end box}}
+{{call box}}
+{{> nope}}
+{{call}}`
+	_, err = Compile(strings.NewReader(src), opts)
+	diags := Diagnostics(err)
+	if assert.Len(t, diags, 1) && assert.NotNil(t, diags[0].Location) {
+		assert.Equal(t, opts.FileName, diags[0].Location.File)
+		assert.Equal(t, 5, diags[0].Location.Line)
+		assert.Contains(t, diags[0].Message, "named block not found: nope")
+	}
+
+	_, err = Compile(strings.NewReader(`{{slot}}`), opts)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "a slot tag must be inside of a named block")
+	}
+}
+
+func TestCompileExtends(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "base.inc"), []byte(`{{block a}}A{{end a}}{{block b}}B{{block c}}C{{end c}}{{end b}}`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "mid.inc"), []byte(`{{extends "base.inc"}}{{block a}}[{{super}}]{{end a}}`), 0644))
+	opts := CompileOptions{FileName: filepath.Join(dir, "t.got")}
+
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		wantErr string
+	}{
+		{"defaults", `{{extends "base.inc"}}`, "ABC", ""},
+		{"override", `{{extends "base.inc"}}{{block a}}X{{end a}}`, "XBC", ""},
+		{"super", `{{extends "base.inc"}}{{block a}}{{super}}{{super}}{{end a}}`, "AABC", ""},
+		{"nested", `{{extends "base.inc"}}{{block c}}X{{end c}}`, "ABX", ""},
+		{"hidden nested", `{{extends "base.inc"}}{{block b}}Y{{end b}}{{block c}}X{{end c}}`, "AY", ""},
+		{"two levels", `{{extends "mid.inc"}}{{block a}}<{{super}}>{{end a}}`, "<[A]>BC", ""},
+		{"defines and comments", "{{# comment }}\n{{extends \"base.inc\"}}\n{{define x}}X{{end x}}\n{{block a}}{{x}}{{end a}}\n{{# comment }}", "XBC", ""},
+		{"unknown", `{{extends "base.inc"}}{{block d}}X{{end d}}`, "", "block d is not in base.inc"},
+		{"duplicate", `{{extends "base.inc"}}{{block a}}X{{end a}}{{block a}}Y{{end a}}`, "", "duplicate block: a"},
+		{"text after extends", `{{extends "base.inc"}}text`, "", "only block tags, comments and named block definitions can come after an extends tag"},
+		{"output before extends", `text{{extends "base.inc"}}`, "", "an extends tag must come before anything that the file outputs"},
+		{"missing file", `{{extends "none.inc"}}`, "", "Could not find include file"},
+		{"super outside block", `{{super}}`, "", "a super tag must be inside of a block tag"},
+		{"super in default", `{{block a}}{{super}}{{end a}}`, "", "block a does not override any content for a super tag to output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Compile(strings.NewReader(tt.src), opts)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				assert.Contains(t, string(out), tt.want)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+
+	// an override of a block that is not in the extended file is located where the override is
+	_, err := Compile(strings.NewReader("{{extends \"base.inc\"}}\n\n{{block d}}X{{end d}}"), opts)
+	if diags := Diagnostics(err); assert.Len(t, diags, 1) && assert.NotNil(t, diags[0].Location) {
+		assert.Equal(t, Location{File: opts.FileName, Line: 3, Column: 12}, *diags[0].Location)
+	}
+}
+
+func TestCompileTranslator(t *testing.T) {
+	src := `{{msg n=1}}{n} item{{msg}}`
+	out, err := Compile(strings.NewReader(src), CompileOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "gotrt.Messages.TranslateMessage(")
+
+	out, err = Compile(strings.NewReader(src), CompileOptions{Translator: "ctx.T()"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "(ctx.T()).TranslateMessage(gotrt.Message{Text: `{n} item`")
+
+	// translate tags use a Translator
+	out, err = Compile(strings.NewReader(`{{t Hello}}`), CompileOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "gotrt.Texts.Translate(`Hello`)")
+
+	out, err = Compile(strings.NewReader(`{{t Hello}}`), CompileOptions{TextTranslator: "ctx.TT()"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "(ctx.TT()).Translate(`Hello`)")
+
+	// a message is escaped for where it lands, like a string value
+	out, err = Compile(strings.NewReader(`{{ <a title="{{msg n=1}}{n} item{{msg}}">}}`), CompileOptions{AutoEscape: true})
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "gotrt.EscapeAttr(gotrt.Messages.TranslateMessage(")
+}
@@ -0,0 +1,463 @@
+package got
+
+import (
+	"strings"
+
+	"github.com/goradd/got/gotrt"
+)
+
+// htmlState is the part of an HTML document that output is going into.
+type htmlState uint8
+
+const (
+	stateText        htmlState = iota // HTML text between tags
+	stateTagName                      // the name of a tag
+	stateTag                          // inside a tag, where an attribute name can go
+	stateAttrName                     // the name of an attribute
+	stateAfterName                    // after the name of an attribute, where an equals sign can go
+	stateBeforeValue                  // after the equals sign of an attribute
+	stateAttr                         // the value of an attribute
+	stateRCDATA                       // the text of an element that cannot hold tags, like a textarea
+	stateComment                      // an HTML comment
+	stateScript                       // the text of a script element
+	stateStyle                        // the text of a style element
+)
+
+// attrType is the kind of content in an attribute value.
+type attrType uint8
+
+const (
+	attrNormal attrType = iota
+	attrURL
+	attrJS
+	attrCSS
+)
+
+// delimType is what ends an attribute value.
+type delimType uint8
+
+const (
+	delimDoubleQuote delimType = iota
+	delimSingleQuote
+	delimSpace
+)
+
+// jsState is the part of a script that output is going into.
+type jsState uint8
+
+const (
+	jsCode jsState = iota
+	jsDoubleQuote
+	jsSingleQuote
+	jsTemplate
+	jsLineComment
+	jsBlockComment
+)
+
+// cssState is the part of a style sheet that output is going into.
+type cssState uint8
+
+const (
+	cssCode cssState = iota
+	cssDoubleQuote
+	cssSingleQuote
+	cssComment
+)
+
+// urlPart is the part of a URL that output is going into.
+type urlPart uint8
+
+const (
+	urlStart urlPart = iota
+	urlPath
+	urlQuery
+)
+
+// htmlContext describes where in an HTML document the output of a template is, so that values can be escaped
+// to suit where they land. It is only tracked when contextual escaping is turned on.
+type htmlContext struct {
+	state   htmlState
+	attr    attrType
+	delim   delimType
+	js      jsState
+	css     cssState
+	url     urlPart
+	element string // the script, style or RCDATA element that a tag opens, or that we are in
+	endTag  bool   // the tag being read is an end tag
+	name    string // the tag or attribute name being read
+	escape  bool   // the last character of a JavaScript or CSS string was a backslash
+	dashes  int    // the number of dashes in a row in a comment
+}
+
+// advance returns the context after the text s is output in context c.
+func (c htmlContext) advance(s string) htmlContext {
+	for i := 0; i < len(s); i++ {
+		i = c.step(s, i)
+	}
+	return c
+}
+
+// step moves c past the character at s[i], and returns the index of the last character used,
+// which is more than i if the character starts a sequence that was used all at once.
+func (c *htmlContext) step(s string, i int) int {
+	ch := s[i]
+	rest := s[i:]
+	switch c.state {
+	case stateText:
+		if ch == '<' {
+			if strings.HasPrefix(rest, "<!--") {
+				c.state = stateComment
+				c.dashes = 0
+				return i + 3
+			}
+			if len(rest) > 1 && (isLetter(rest[1]) || rest[1] == '/') {
+				c.state = stateTagName
+				c.name = ""
+				c.endTag = rest[1] == '/'
+				if c.endTag {
+					return i + 1
+				}
+			}
+		}
+
+	case stateComment:
+		if ch == '-' {
+			c.dashes++
+		} else if ch == '>' && c.dashes >= 2 {
+			*c = htmlContext{}
+		} else {
+			c.dashes = 0
+		}
+
+	case stateTagName:
+		if isLetter(ch) || ch >= '0' && ch <= '9' || ch == '-' || ch == ':' {
+			c.name += strings.ToLower(string(ch))
+			break
+		}
+		c.element = ""
+		if !c.endTag {
+			switch c.name {
+			case "script", "style", "textarea", "title":
+				c.element = c.name
+			}
+		}
+		c.inTag()
+		return c.step(s, i)
+
+	case stateTag:
+		if ch == '>' {
+			c.endOfTag()
+		} else if !isWhiteSpace(rune(ch)) && ch != '/' {
+			c.state = stateAttrName
+			c.name = strings.ToLower(string(ch))
+		}
+
+	case stateAttrName:
+		switch {
+		case ch == '=':
+			c.startAttr()
+			c.state = stateBeforeValue
+		case ch == '>':
+			c.endOfTag()
+		case ch == '/':
+			c.state = stateTag
+		case isWhiteSpace(rune(ch)):
+			c.startAttr()
+			c.state = stateAfterName
+		default:
+			c.name += strings.ToLower(string(ch))
+		}
+
+	case stateAfterName:
+		switch {
+		case ch == '=':
+			c.state = stateBeforeValue
+		case ch == '>':
+			c.endOfTag()
+		case ch == '/':
+			c.state = stateTag
+		case !isWhiteSpace(rune(ch)):
+			c.state = stateAttrName
+			c.name = strings.ToLower(string(ch))
+		}
+
+	case stateBeforeValue:
+		switch {
+		case ch == '"':
+			c.state = stateAttr
+			c.delim = delimDoubleQuote
+		case ch == '\'':
+			c.state = stateAttr
+			c.delim = delimSingleQuote
+		case ch == '>':
+			c.endOfTag()
+		case !isWhiteSpace(rune(ch)):
+			c.state = stateAttr
+			c.delim = delimSpace
+			return c.step(s, i)
+		}
+
+	case stateAttr:
+		switch {
+		case c.delim == delimDoubleQuote && ch == '"',
+			c.delim == delimSingleQuote && ch == '\'',
+			c.delim == delimSpace && isWhiteSpace(rune(ch)):
+			c.inTag()
+		case c.delim == delimSpace && ch == '>':
+			c.endOfTag()
+		default:
+			switch c.attr {
+			case attrURL:
+				if ch == '?' || ch == '#' {
+					c.url = urlQuery
+				} else if c.url == urlStart {
+					c.url = urlPath
+				}
+			case attrJS:
+				return c.stepJS(s, i)
+			case attrCSS:
+				return c.stepCSS(s, i)
+			}
+		}
+
+	case stateScript, stateStyle, stateRCDATA:
+		if ch == '<' && len(rest) > len(c.element)+2 && strings.EqualFold(rest[2:2+len(c.element)], c.element) && rest[1] == '/' {
+			c.state = stateTagName
+			c.endTag = true
+			c.name = ""
+			return i + 1
+		}
+		if c.state == stateScript {
+			return c.stepJS(s, i)
+		} else if c.state == stateStyle {
+			return c.stepCSS(s, i)
+		}
+	}
+	return i
+}
+
+// startAttr sets up the context for the value of the attribute that was just named.
+func (c *htmlContext) startAttr() {
+	c.attr = attrNormal
+	switch {
+	case strings.HasPrefix(c.name, "on"):
+		c.attr = attrJS
+	case c.name == "style":
+		c.attr = attrCSS
+	case gotrt.IsURLAttr(c.name):
+		c.attr = attrURL
+	}
+	c.js = jsCode
+	c.css = cssCode
+	c.url = urlStart
+	c.escape = false
+}
+
+// inTag moves the context to where an attribute name can go, clearing what was kept for the tag name or attribute before it.
+// Contexts that describe the same place are kept equal, so that they can be compared.
+func (c *htmlContext) inTag() {
+	*c = htmlContext{state: stateTag, element: c.element, endTag: c.endTag}
+}
+
+// endOfTag moves the context past the end of a tag, into the text of the element the tag starts.
+func (c *htmlContext) endOfTag() {
+	switch {
+	case c.endTag || c.element == "":
+		*c = htmlContext{state: stateText}
+	case c.element == "script":
+		*c = htmlContext{state: stateScript, element: c.element}
+	case c.element == "style":
+		*c = htmlContext{state: stateStyle, element: c.element}
+	default:
+		*c = htmlContext{state: stateRCDATA, element: c.element}
+	}
+}
+
+func (c *htmlContext) stepJS(s string, i int) int {
+	ch := s[i]
+	next := byte(0)
+	if i+1 < len(s) {
+		next = s[i+1]
+	}
+	switch c.js {
+	case jsCode:
+		switch {
+		case ch == '"':
+			c.js = jsDoubleQuote
+		case ch == '\'':
+			c.js = jsSingleQuote
+		case ch == '`':
+			c.js = jsTemplate
+		case ch == '/' && next == '/':
+			c.js = jsLineComment
+			return i + 1
+		case ch == '/' && next == '*':
+			c.js = jsBlockComment
+			return i + 1
+		}
+	case jsDoubleQuote, jsSingleQuote, jsTemplate:
+		switch {
+		case c.escape:
+			c.escape = false
+		case ch == '\\':
+			c.escape = true
+		case ch == '"' && c.js == jsDoubleQuote, ch == '\'' && c.js == jsSingleQuote, ch == '`' && c.js == jsTemplate:
+			c.js = jsCode
+		}
+	case jsLineComment:
+		if ch == '\n' {
+			c.js = jsCode
+		}
+	case jsBlockComment:
+		if ch == '*' && next == '/' {
+			c.js = jsCode
+			return i + 1
+		}
+	}
+	return i
+}
+
+func (c *htmlContext) stepCSS(s string, i int) int {
+	ch := s[i]
+	next := byte(0)
+	if i+1 < len(s) {
+		next = s[i+1]
+	}
+	switch c.css {
+	case cssCode:
+		switch {
+		case ch == '"':
+			c.css = cssDoubleQuote
+		case ch == '\'':
+			c.css = cssSingleQuote
+		case ch == '/' && next == '*':
+			c.css = cssComment
+			return i + 1
+		}
+	case cssDoubleQuote, cssSingleQuote:
+		switch {
+		case c.escape:
+			c.escape = false
+		case ch == '\\':
+			c.escape = true
+		case ch == '"' && c.css == cssDoubleQuote, ch == '\'' && c.css == cssSingleQuote:
+			c.css = cssCode
+		}
+	case cssComment:
+		if ch == '*' && next == '/' {
+			c.css = cssCode
+			return i + 1
+		}
+	}
+	return i
+}
+
+// afterValue returns the context after a value is output in context c.
+func (c htmlContext) afterValue() htmlContext {
+	switch {
+	case c.state == stateBeforeValue:
+		// the value starts an attribute value that is not in quotes
+		c.state = stateAttr
+		c.delim = delimSpace
+		if c.attr == attrURL {
+			c.url = urlPath
+		}
+	case c.state == stateAttr && c.attr == attrURL && c.url == urlStart:
+		c.url = urlPath
+	}
+	return c
+}
+
+// escapers returns the names of the gotrt functions that make a value safe in context c, in the order they should be applied.
+// jsValue is true if the value should be given to the escapers as is, rather than first being converted to a string,
+// so that it can be output as a JavaScript value of the same type.
+func (c htmlContext) escapers() (escapers []string, jsValue bool) {
+	switch c.state {
+	case stateText:
+		return []string{"EscapeHTML"}, false
+	case stateRCDATA, stateComment:
+		return []string{"EscapeRCDATA"}, false
+	case stateTagName, stateTag, stateAttrName, stateAfterName:
+		return []string{"EscapeAttrName"}, false
+	case stateScript:
+		return c.jsEscapers()
+	case stateStyle:
+		return c.cssEscapers(), false
+	}
+
+	// in an attribute value
+	switch c.attr {
+	case attrURL:
+		switch c.url {
+		case urlStart:
+			escapers = []string{"EscapeURL"}
+		case urlPath:
+			escapers = []string{"NormalizeURL"}
+		default:
+			escapers = []string{"EscapeURLQuery"}
+		}
+	case attrJS:
+		escapers, jsValue = c.jsEscapers()
+	case attrCSS:
+		escapers = c.cssEscapers()
+	}
+	if c.state == stateBeforeValue || c.delim == delimSpace {
+		escapers = append(escapers, "EscapeAttrUnquoted")
+	} else {
+		escapers = append(escapers, "EscapeAttr")
+	}
+	return
+}
+
+func (c htmlContext) jsEscapers() ([]string, bool) {
+	if c.js == jsCode {
+		return []string{"EscapeJS"}, true
+	}
+	return []string{"EscapeJSString"}, false
+}
+
+func (c htmlContext) cssEscapers() []string {
+	if c.css == cssCode {
+		return []string{"EscapeCSS"}
+	}
+	return []string{"EscapeCSSString"}
+}
+
+// String describes the context for error messages.
+func (c htmlContext) String() string {
+	switch c.state {
+	case stateText:
+		return "HTML text"
+	case stateTagName, stateTag, stateAttrName, stateAfterName:
+		return "a tag"
+	case stateBeforeValue, stateAttr:
+		switch c.attr {
+		case attrURL:
+			return "a URL attribute value"
+		case attrJS:
+			return "a JavaScript attribute value"
+		case attrCSS:
+			return "a style attribute value"
+		}
+		return "an attribute value"
+	case stateRCDATA:
+		return "a " + c.element + " element"
+	case stateComment:
+		return "an HTML comment"
+	case stateScript:
+		if c.js != jsCode {
+			return "a JavaScript string or comment"
+		}
+		return "a script element"
+	case stateStyle:
+		if c.css != cssCode {
+			return "a CSS string or comment"
+		}
+		return "a style element"
+	}
+	return "an unknown context"
+}
+
+func isLetter(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
@@ -0,0 +1,72 @@
+package got
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_htmlContext(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		escapers  []string
+		jsValue   bool
+		wantState htmlState
+	}{
+		{"text", "<p>Hello ", []string{"EscapeHTML"}, false, stateText},
+		{"after end tag", "<p>a</p>", []string{"EscapeHTML"}, false, stateText},
+		{"comment", "<!-- a ", []string{"EscapeRCDATA"}, false, stateComment},
+		{"after comment", "<!-- a -- b --> ", []string{"EscapeHTML"}, false, stateText},
+		{"textarea", "<textarea>", []string{"EscapeRCDATA"}, false, stateRCDATA},
+		{"after textarea", "<textarea><b></TEXTAREA>", []string{"EscapeHTML"}, false, stateText},
+		{"tag", "<input ", []string{"EscapeAttrName"}, false, stateTag},
+		{"attribute name", "<input a", []string{"EscapeAttrName"}, false, stateAttrName},
+		{"quoted", `<input value="`, []string{"EscapeAttr"}, false, stateAttr},
+		{"single quoted", `<input value='a `, []string{"EscapeAttr"}, false, stateAttr},
+		{"before value", `<input value=`, []string{"EscapeAttrUnquoted"}, false, stateBeforeValue},
+		{"after value", `<input value="a" `, []string{"EscapeAttrName"}, false, stateTag},
+		{"url", `<a href="`, []string{"EscapeURL", "EscapeAttr"}, false, stateAttr},
+		{"url path", `<a HREF="/a/`, []string{"NormalizeURL", "EscapeAttr"}, false, stateAttr},
+		{"url query", `<a href="/a?b=`, []string{"EscapeURLQuery", "EscapeAttr"}, false, stateAttr},
+		{"unquoted url", `<img src=`, []string{"EscapeURL", "EscapeAttrUnquoted"}, false, stateBeforeValue},
+		{"event", `<a onclick="f(`, []string{"EscapeJS", "EscapeAttr"}, true, stateAttr},
+		{"event string", `<a onclick="f('`, []string{"EscapeJSString", "EscapeAttr"}, false, stateAttr},
+		{"style attribute", `<a style="color: `, []string{"EscapeCSS", "EscapeAttr"}, false, stateAttr},
+		{"script", "<script>var a = ", []string{"EscapeJS"}, true, stateScript},
+		{"script string", `<script>var a = "b\"`, []string{"EscapeJSString"}, false, stateScript},
+		{"script template", "<script>var a = `", []string{"EscapeJSString"}, false, stateScript},
+		{"script line comment", "<script>// a ", []string{"EscapeJSString"}, false, stateScript},
+		{"script after comment", "<script>/* a */ f(", []string{"EscapeJS"}, true, stateScript},
+		{"tags in script", "<script>var a = '<b>'; ", []string{"EscapeJS"}, true, stateScript},
+		{"after script", "<script>a()</script>", []string{"EscapeHTML"}, false, stateText},
+		{"style", "<style>p { color: ", []string{"EscapeCSS"}, false, stateStyle},
+		{"style string", `<style>p { font-family: "`, []string{"EscapeCSSString"}, false, stateStyle},
+		{"after style", "<style>p {}</style>", []string{"EscapeHTML"}, false, stateText},
+		{"attribute named like an element", `<a title="script">`, []string{"EscapeHTML"}, false, stateText},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := htmlContext{}.advance(tt.text)
+			assert.Equal(t, tt.wantState, c.state)
+			escapers, jsValue := c.escapers()
+			assert.Equal(t, tt.escapers, escapers)
+			assert.Equal(t, tt.jsValue, jsValue)
+		})
+	}
+}
+
+func Test_htmlContextAfterValue(t *testing.T) {
+	// a value right after the equals sign starts an unquoted attribute value, which ends at white space
+	c := htmlContext{}.advance(`<a href=`).afterValue()
+	escapers, _ := c.escapers()
+	assert.Equal(t, []string{"NormalizeURL", "EscapeAttrUnquoted"}, escapers)
+	c = c.advance(` title=`)
+	assert.Equal(t, stateBeforeValue, c.state)
+	assert.Equal(t, attrNormal, c.attr)
+
+	c = htmlContext{}.advance(`<a href="`).afterValue()
+	escapers, _ = c.escapers()
+	assert.Equal(t, []string{"NormalizeURL", "EscapeAttr"}, escapers)
+	assert.Equal(t, htmlContext{}, c.advance(`">a</a>`))
+}
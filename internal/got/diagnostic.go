@@ -0,0 +1,142 @@
+package got
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Location is a position in a template file, or in a named block.
+type Location struct {
+	// File is the path of the file, if the location is in a file.
+	File string `json:"file,omitempty"`
+	// Block is the name of the named block, if the location is in a block rather than a file.
+	Block string `json:"block,omitempty"`
+	// Line is the line number, starting at 1.
+	Line int `json:"line"`
+	// Column is the character number in the line, starting at 1.
+	Column int `json:"column"`
+}
+
+// Diagnostic describes a problem found while processing a template.
+type Diagnostic struct {
+	// Severity is "error" for problems that stop the template from being processed.
+	Severity string `json:"severity"`
+	// Message describes the problem.
+	Message string `json:"message"`
+	// Location is where the problem was found. Problems found inside named blocks are located
+	// in the file where the block was defined. It is nil if the problem is not in a template.
+	Location *Location `json:"location,omitempty"`
+	// CallStack lists where the problem was found, followed by the blocks and include files
+	// it was reached through, ending with the template itself.
+	CallStack []Location `json:"callStack,omitempty"`
+}
+
+// TemplateError is the error returned for a template that has problems.
+type TemplateError struct {
+	Diagnostics []Diagnostic
+}
+
+// newTemplateError returns the error for an error item produced by the parser.
+func newTemplateError(item tokenItem) *TemplateError {
+	items := item.childItems
+	if len(items) == 0 {
+		items = []tokenItem{item}
+	}
+	e := new(TemplateError)
+	for _, i := range items {
+		e.Diagnostics = append(e.Diagnostics, newDiagnostic(i))
+	}
+	return e
+}
+
+func newDiagnostic(item tokenItem) Diagnostic {
+	d := Diagnostic{Severity: "error", Message: item.val}
+	if ref, ok := item.sourceLocation(); ok {
+		l := ref.location()
+		d.Location = &l
+	} else if len(item.callStack) > 0 {
+		l := item.callStack[0].location()
+		d.Location = &l
+	}
+	for _, ref := range item.callStack {
+		d.CallStack = append(d.CallStack, ref.location())
+	}
+	return d
+}
+
+func (r locationRef) location() Location {
+	return Location{
+		File:   r.fileName,
+		Block:  r.blockName,
+		Line:   r.lineNum + 1,
+		Column: r.offset + 1,
+	}
+}
+
+// String returns the location in the file:line:column form.
+func (l Location) String() string {
+	if l.Block != "" {
+		return fmt.Sprintf("Block %s:%d:%d", l.Block, l.Line, l.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", l.File, l.Line, l.Column)
+}
+
+// String returns the diagnostic in the file:line:column: message form that editors understand,
+// followed by indented lines showing where the location was reached from.
+func (d Diagnostic) String() string {
+	if d.Location == nil {
+		return d.Message
+	}
+	s := d.Location.String() + ": " + d.Message
+	for i, l := range d.CallStack {
+		if i == 0 && l == *d.Location {
+			continue
+		}
+		s += "\n\tfrom " + l.String()
+	}
+	return s
+}
+
+func (e *TemplateError) Error() string {
+	var lines []string
+	for _, d := range e.Diagnostics {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Diagnostics returns the diagnostics described by err. Errors returned by RunWithOptions and Compile may
+// combine the errors of several templates, and errors that are not about a particular template location are
+// returned as diagnostics without a location.
+func Diagnostics(err error) (diags []Diagnostic) {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *TemplateError:
+		return e.Diagnostics
+	case interface{ Unwrap() []error }:
+		for _, e2 := range e.Unwrap() {
+			diags = append(diags, Diagnostics(e2)...)
+		}
+		return
+	}
+	var te *TemplateError
+	if errors.As(err, &te) {
+		return te.Diagnostics
+	}
+	return []Diagnostic{{Severity: "error", Message: err.Error()}}
+}
+
+// WriteJSONDiagnostics writes the diagnostics described by err to w as JSON, one diagnostic per line.
+func WriteJSONDiagnostics(w io.Writer, err error) error {
+	enc := json.NewEncoder(w)
+	for _, d := range Diagnostics(err) {
+		if err2 := enc.Encode(d); err2 != nil {
+			return err2
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package got
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	incPath := filepath.Join(dir, "bad.inc")
+	tplPath := filepath.Join(dir, "a.tpl.got")
+	assert.NoError(t, os.WriteFile(incPath, []byte("\n  {{i }}"), 0644))
+
+	src := "{{< blk}}\n{{= }}{{end blk}}\n{{: bad.inc }}\n{{blk}}"
+	_, err := Compile(strings.NewReader(src), CompileOptions{FileName: tplPath})
+	if !assert.Error(t, err) {
+		return
+	}
+
+	diags := Diagnostics(err)
+	if assert.Len(t, diags, 2) {
+		d := diags[0]
+		assert.Equal(t, "error", d.Severity)
+		assert.Equal(t, "missing value", d.Message)
+		assert.Equal(t, Location{File: incPath, Line: 2, Column: 3}, *d.Location)
+		assert.Equal(t, []Location{
+			{File: incPath, Line: 2, Column: 3},
+			{File: tplPath, Line: 3, Column: 15},
+		}, d.CallStack)
+
+		// errors in blocks are located where the block was defined
+		d = diags[1]
+		assert.Equal(t, Location{File: tplPath, Line: 2, Column: 1}, *d.Location)
+		assert.Equal(t, "blk", d.CallStack[0].Block)
+		assert.Equal(t, tplPath, d.CallStack[len(d.CallStack)-1].File)
+	}
+
+	lines := strings.Split(err.Error(), "\n")
+	assert.Equal(t, incPath+":2:3: missing value", lines[0])
+	assert.Equal(t, "\tfrom "+tplPath+":3:15", lines[1])
+
+	var b bytes.Buffer
+	assert.NoError(t, WriteJSONDiagnostics(&b, err))
+	jsonLines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if assert.Len(t, jsonLines, 2) {
+		var d Diagnostic
+		assert.NoError(t, json.Unmarshal([]byte(jsonLines[0]), &d))
+		assert.Equal(t, diags[0], d)
+		assert.Contains(t, jsonLines[0], `"severity":"error"`)
+		assert.Contains(t, jsonLines[0], `"callStack":[`)
+	}
+}
+
+func TestDiagnosticsJoined(t *testing.T) {
+	_, err1 := Compile(strings.NewReader("{{i }}"), CompileOptions{FileName: "a.tpl.got"})
+	err := errors.Join(err1, errors.New("other problem"))
+	diags := Diagnostics(err)
+	if assert.Len(t, diags, 2) {
+		assert.Equal(t, "missing value", diags[0].Message)
+		assert.NotNil(t, diags[0].Location)
+		assert.Equal(t, "other problem", diags[1].Message)
+		assert.Nil(t, diags[1].Location)
+	}
+	assert.Nil(t, Diagnostics(nil))
+}
@@ -0,0 +1,214 @@
+package got
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// The formats that Extract can write a catalog in.
+const (
+	// CatalogPOT is a gettext template, which translation tools use to start or update the translations of each language.
+	CatalogPOT = "pot"
+	// CatalogJSON is a JSON array of messages, for tools of your own.
+	CatalogJSON = "json"
+)
+
+// catalogEntry is a message found in the templates that needs to be translated.
+type catalogEntry struct {
+	// ID is the id given to a msg tag, if it has one.
+	ID string `json:"id,omitempty"`
+	// Context is the context given to a msg tag, if it has one.
+	Context string `json:"context,omitempty"`
+	// Text is the text that is passed to the translator.
+	Text string `json:"text"`
+	// Plural is the plural text of a msg tag, if it has one.
+	Plural string `json:"plural,omitempty"`
+	// References are the places in the templates that the message was found.
+	References []Location `json:"references"`
+}
+
+// key identifies the message, so that the same message found in different places is only translated once.
+func (e *catalogEntry) key() string {
+	if e.ID != "" {
+		return e.Context + "\x04" + e.ID
+	}
+	return e.Context + "\x04" + e.Text
+}
+
+// catalog collects the messages to translate found while walking the asts of templates.
+type catalog struct {
+	entries []*catalogEntry
+	index   map[string]*catalogEntry
+}
+
+// add adds a message to the catalog, or adds the references of the message to the entry for the same message.
+func (c *catalog) add(e catalogEntry) {
+	if c.index == nil {
+		c.index = make(map[string]*catalogEntry)
+	}
+	existing, ok := c.index[e.key()]
+	if !ok {
+		c.entries = append(c.entries, &e)
+		c.index[e.key()] = &e
+		return
+	}
+	if existing.Plural == "" {
+		existing.Plural = e.Plural
+	}
+	for _, ref := range e.References {
+		if !containsLocation(existing.References, ref) {
+			existing.References = append(existing.References, ref)
+		}
+	}
+}
+
+func containsLocation(locations []Location, l Location) bool {
+	for _, l2 := range locations {
+		if l2 == l {
+			return true
+		}
+	}
+	return false
+}
+
+// addItem adds a message found at the location of item.
+func (c *catalog) addItem(item tokenItem, e catalogEntry) {
+	if ref, ok := item.sourceLocation(); ok {
+		e.References = []Location{ref.location()}
+	} else if len(item.callStack) > 0 {
+		e.References = []Location{item.callStack[0].location()}
+	}
+	c.add(e)
+}
+
+// relativeTo makes the file names of the references relative to dir, where possible.
+func (c *catalog) relativeTo(dir string) {
+	for _, e := range c.entries {
+		for i, ref := range e.References {
+			if ref.File == "" {
+				continue
+			}
+			if rel, err := filepath.Rel(dir, ref.File); err == nil {
+				e.References[i].File = filepath.ToSlash(rel)
+			}
+		}
+	}
+}
+
+// Extract reads the templates described by opts, the same way RunWithOptions does, and writes a catalog of the text
+// they send to translators to w, in the given format. The text of translate tags and the messages of msg tags are
+// included, from the templates themselves and from the files and named blocks that they include. Every template is read,
+// whether its output file is out of date or not, and no output files are written.
+func Extract(opts Options, format string, w io.Writer) error {
+	if format != CatalogPOT && format != CatalogJSON {
+		return fmt.Errorf("unknown catalog format %q. Use %s or %s", format, CatalogPOT, CatalogJSON)
+	}
+	r, err := newRunner(opts)
+	if err != nil {
+		return err
+	}
+	r.catalogs = make(map[string]*catalog)
+
+	files, err := r.gatherFiles(true)
+	if err != nil {
+		return err
+	}
+	if err = errors.Join(r.processFiles(files)...); err != nil {
+		return err
+	}
+
+	// merge the catalogs in the order of the files, so that the output is the same on every run
+	all := new(catalog)
+	for _, f := range files {
+		if c := r.catalogs[filepath.FromSlash(f)]; c != nil {
+			for _, e := range c.entries {
+				all.add(*e)
+			}
+		}
+	}
+	all.relativeTo(r.cwd)
+
+	if format == CatalogJSON {
+		return all.writeJSON(w)
+	}
+	return all.writePOT(w)
+}
+
+func (c *catalog) writeJSON(w io.Writer) error {
+	entries := c.entries
+	if entries == nil {
+		entries = []*catalogEntry{}
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// writePOT writes the catalog as a gettext template. A message with an id uses the id as its msgid, and its text is
+// given in a comment for the translator.
+func (c *catalog) writePOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("# Messages extracted from GoT templates.\n")
+	b.WriteString("msgid \"\"\nmsgstr \"\"\n\"Content-Type: text/plain; charset=UTF-8\\n\"\n")
+	for _, e := range c.entries {
+		b.WriteString("\n")
+		if e.ID != "" {
+			for _, line := range strings.Split(e.Text, "\n") {
+				b.WriteString("#. " + line + "\n")
+			}
+		}
+		for _, ref := range e.References {
+			if ref.File != "" {
+				fmt.Fprintf(&b, "#: %s:%d\n", ref.File, ref.Line)
+			}
+		}
+		if e.Context != "" {
+			b.WriteString("msgctxt " + poString(e.Context))
+		}
+		if e.ID != "" {
+			b.WriteString("msgid " + poString(e.ID))
+		} else {
+			b.WriteString("msgid " + poString(e.Text))
+		}
+		if e.Plural != "" {
+			b.WriteString("msgid_plural " + poString(e.Plural))
+			b.WriteString("msgstr[0] \"\"\nmsgstr[1] \"\"\n")
+		} else {
+			b.WriteString("msgstr \"\"\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// poString returns s as a quoted gettext string, followed by a newline. A string with more than one line is split
+// after each newline, with each line quoted on a line of its own.
+func poString(s string) string {
+	quote := func(s string) string {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+		s = strings.ReplaceAll(s, `"`, `\"`)
+		s = strings.ReplaceAll(s, "\t", `\t`)
+		s = strings.ReplaceAll(s, "\r", `\r`)
+		s = strings.ReplaceAll(s, "\n", `\n`)
+		return `"` + s + `"` + "\n"
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= 1 {
+		return quote(s)
+	}
+	out := `""` + "\n"
+	for _, line := range lines {
+		out += quote(line)
+	}
+	return out
+}
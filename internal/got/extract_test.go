@@ -0,0 +1,64 @@
+package got
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	tpl := filepath.Join(dir, "a.tpl.got")
+	assert.NoError(t, os.WriteFile(tpl, []byte(`{{define greet}}{{t Hello}}{{end greet}}
+{{greet}}
+{{greet}}
+{{: "b.inc" }}
+{{!t a & b}}
+`), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.inc"), []byte(`{{msg id="files", context="disk", count=n}}one "file"{{plural}}{count} files
+on disk{{msg}}`), 0644))
+
+	opts := Options{Files: []string{tpl}}
+	var b bytes.Buffer
+	assert.NoError(t, Extract(opts, CatalogJSON, &b))
+	var entries []catalogEntry
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &entries))
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "Hello", entries[0].Text)
+		// a block used twice is found at one place, where it is defined
+		if assert.Len(t, entries[0].References, 1) {
+			assert.Equal(t, 1, entries[0].References[0].Line)
+			assert.Equal(t, "a.tpl.got", filepath.Base(entries[0].References[0].File))
+		}
+		assert.Equal(t, catalogEntry{ID: "files", Context: "disk", Text: `one "file"`, Plural: "{count} files\non disk",
+			References: entries[1].References}, entries[1])
+		if assert.Len(t, entries[1].References, 1) {
+			assert.Equal(t, "b.inc", filepath.Base(entries[1].References[0].File))
+		}
+		// escaped text is translated after it is escaped
+		assert.Equal(t, "a &amp; b", entries[2].Text)
+	}
+
+	b.Reset()
+	assert.NoError(t, Extract(opts, CatalogPOT, &b))
+	assert.Contains(t, b.String(), `#. one "file"
+#: `)
+	assert.Contains(t, b.String(), `msgctxt "disk"
+msgid "files"
+msgid_plural ""
+"{count} files\n"
+"on disk"
+msgstr[0] ""
+msgstr[1] ""
+`)
+
+	// nothing is written
+	_, err := os.Stat(filepath.Join(dir, "a.tpl.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Error(t, Extract(opts, "xliff", &b))
+}
@@ -0,0 +1,93 @@
+package got
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	goparser "go/parser"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// finishSource adds the packages that the generated code needs to the import block of src, and formats it.
+// The template author only has to import the packages that their own code uses.
+//
+// If src does not start with a package clause, the template may be producing a fragment of code for something
+// else to use, like a list of declarations or statements. A fragment is formatted if it can be, and returned as is
+// otherwise, since it may only be valid Go once it is put together with the code around it. Imports are not added
+// to a fragment. Otherwise, src must be valid Go, and if it is not, the returned error points to the places in the
+// templates that generated the code that could not be formatted.
+func (c *compilation) finishSource(src []byte, asts []astType) ([]byte, error) {
+	if !isGoFile(src) {
+		if out, err := format.Source(src); err == nil {
+			return out, nil
+		}
+		return src, nil
+	}
+	out, err := addImports(src, c.importList())
+	if err == nil {
+		out, err = format.Source(out)
+	}
+	if err != nil {
+		return nil, c.sourceError(err, asts)
+	}
+	return out, nil
+}
+
+// isGoFile returns true if src starts with a package clause.
+func isGoFile(src []byte) bool {
+	_, err := goparser.ParseFile(token.NewFileSet(), "", src, goparser.PackageClauseOnly)
+	return err == nil
+}
+
+// sourceItemPrefix starts the file names of the line directives that point to items in compilation.sourceItems.
+const sourceItemPrefix = "got-item-"
+
+// sourceError returns the error for generated code that could not be parsed, located at the places in the templates that
+// generated the code. To find them, the code is generated again with line directives that point to the template items
+// the code came from, which the Go parser uses to report positions. The call stacks of those items then show the blocks
+// and include files that the code was reached through.
+func (c *compilation) sourceError(err error, asts []astType) error {
+	var list scanner.ErrorList
+	if !errors.As(err, &list) {
+		return err
+	}
+
+	c.sourceItems = []tokenItem{}
+	var buf bytes.Buffer
+	err2 := c.writeAsts(&buf, "", asts...)
+	items := c.sourceItems
+	c.sourceItems = nil
+	if err2 == nil {
+		_, err2 = goparser.ParseFile(token.NewFileSet(), "", buf.Bytes(), goparser.AllErrors)
+		errors.As(err2, &list)
+	}
+
+	e := new(TemplateError)
+	for _, se := range list {
+		message := "generated Go code does not parse: " + se.Msg
+		n, err3 := strconv.Atoi(strings.TrimPrefix(se.Pos.Filename, sourceItemPrefix))
+		if err3 != nil || n >= len(items) || !strings.HasPrefix(se.Pos.Filename, sourceItemPrefix) {
+			e.Diagnostics = append(e.Diagnostics, Diagnostic{
+				Severity: "error",
+				Message:  message + fmt.Sprintf(" (line %d of the generated code)", se.Pos.Line),
+			})
+			continue
+		}
+		item := items[n]
+		item.val = message
+		item.callStack = append([]locationRef(nil), item.callStack...)
+		// the error may be past the start of the item, so move its location by as much
+		if se.Pos.Line == 1 {
+			item.callStack[0].offset += se.Pos.Column - 1
+		} else {
+			item.callStack[0].lineNum += se.Pos.Line - 1
+			item.callStack[0].offset = se.Pos.Column - 1
+		}
+		e.Diagnostics = append(e.Diagnostics, newDiagnostic(item))
+	}
+	return e
+}
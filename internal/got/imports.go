@@ -0,0 +1,97 @@
+package got
+
+import (
+	"bytes"
+	"fmt"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// addImport records that the generated code calls into the package with the given import path.
+func (c *compilation) addImport(importPath string) {
+	if c.imports == nil {
+		c.imports = make(map[string]struct{})
+	}
+	c.imports[importPath] = struct{}{}
+}
+
+// helperPackageRegex finds the packages that the code GoT generates calls into.
+var helperPackageRegex = regexp.MustCompile(`\b(fmt|html|io|strconv|strings|gotrt)\.`)
+
+// useHelpers records the packages called by the given generated code. The code must not include code from the template,
+// since the template may use a package name for something else.
+func (a *astWalker) useHelpers(code string) {
+	for _, m := range helperPackageRegex.FindAllStringSubmatch(code, -1) {
+		if m[1] == "gotrt" {
+			a.c.addImport("github.com/goradd/got/gotrt")
+		} else {
+			a.c.addImport(m[1])
+		}
+	}
+}
+
+// importList returns the import paths of the packages the generated code calls into, sorted.
+func (c *compilation) importList() (paths []string) {
+	for p := range c.imports {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return
+}
+
+// addImports adds the packages with the given import paths to the imports of the Go file in src,
+// if the file does not already import them under their own names.
+func addImports(src []byte, importPaths []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := goparser.ParseFile(fset, "", src, goparser.ImportsOnly|goparser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := make(map[string]bool)
+	for _, spec := range f.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		if spec.Name == nil || spec.Name.Name == path.Base(p) {
+			imported[p] = true
+		}
+	}
+	var lines []byte
+	for _, p := range importPaths {
+		if !imported[p] {
+			lines = append(lines, "\t"+strconv.Quote(p)+"\n"...)
+		}
+	}
+	if lines == nil {
+		return src, nil
+	}
+
+	// add to the first import declaration that is in parentheses, or else start a new one after the package clause
+	pos := f.Name.End()
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*goast.GenDecl); ok && gen.Tok == token.IMPORT && gen.Rparen.IsValid() {
+			pos = gen.Rparen
+			break
+		}
+	}
+	if pos == f.Name.End() {
+		lines = append(append([]byte("\n\nimport (\n"), lines...), ")\n"...)
+	} else {
+		lines = append([]byte("\n"), lines...)
+	}
+	offset := fset.Position(pos).Offset
+	if p := fset.PositionFor(pos, true); p.Filename != "" {
+		// a line directive maps the code to the template, so restore the mapping for the code after the new lines
+		lines = append(lines, fmt.Sprintf("/*line %s:%d:%d*/", p.Filename, p.Line, p.Column)...)
+	}
+
+	var out bytes.Buffer
+	out.Write(src[:offset])
+	out.Write(lines)
+	out.Write(src[offset:])
+	return out.Bytes(), nil
+}
@@ -9,17 +9,23 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/scanner"
 )
 
+// defaultMaxExpansionDepth is how deeply named blocks and include files may be nested inside each other, if not otherwise specified.
+const defaultMaxExpansionDepth = 100
+
 const eof rune = -1
 const errRune rune = -2
 
 type lexer struct {
+	c             *compilation   // the compilation this lexer is a part of
 	fileName      string         // file name being scanned
 	blockName     string         // named block being scanned
+	blockRef      locationRef    // where the named block being scanned was defined
 	input         *bufio.Reader  // stream being scanned
 	items         chan tokenItem // channel of scanned items
 	curBuffer     []rune         // current character run
@@ -28,78 +34,172 @@ type lexer struct {
 	backBuffer    []rune         // items that were put back into the lexer after a peek
 	relativePaths []string       // when including files, keeps track of the relative paths to search
 	namedBlocks   map[string]namedBlockEntry
-	err           error // most recent error
+	expansion     *expansion             // the block or file being scanned, linked to where it was substituted or included from
+	slots         map[string]slotContent // the content given to the slots of the block being scanned. nil when scanning a file.
+	block         *blockTag              // the overridable block being scanned, for super tags. nil if not in one.
+	hasOutput     bool                   // true once something other than white space has been emitted
+	err           error                  // most recent error
+}
+
+// slotContent is the content that a call tag gives to a slot of a named block. The content is scanned as if it were
+// still where it was written, so that it keeps its locations, and the slots and include paths of its surroundings.
+type slotContent struct {
+	text   string
+	ref    locationRef // where the content starts
+	caller *lexer      // the lexer that scanned the call tag
+}
+
+// blockOverride is the content that a file that extends another file gives to one of the blocks of the other file.
+type blockOverride struct {
+	name    string
+	content slotContent
+	used    bool // true once a block with the name is found in the file that is extended
+}
+
+// blockTag is an overridable block being scanned. supers are the contents that the content being scanned overrides,
+// in order, ending with the content of the block tag itself.
+type blockTag struct {
+	name   string
+	supers []slotContent
+}
+
+// expansion is a named block or file that is being lexed. Each expansion links back to the expansion it was
+// substituted or included from, so that a block or file that would expand itself forever can be detected.
+type expansion struct {
+	parent *expansion
+	depth  int
+	desc   string // describes the block or file for error messages
+	key    string // identifies the block definition or file
+	// overrides are the contents given to the blocks of the file by the files that extend it, in order from the file
+	// that extends the others. It is nil if the file is not extended.
+	overrides map[string][]*blockOverride
 }
 
 type stateFn func(*lexer) stateFn
 
 // lex opens the file and returns a lexer that will emit tokens on
 // the lexer's channel
-func lexFile(fileName string,
+//
+// from is the expansion that the file is included from, or nil if it is not included.
+func lexFile(c *compilation,
+	fileName string,
+	reader io.Reader,
+	namedBlocks map[string]namedBlockEntry,
+	from *expansion,
+	relPaths ...string) *lexer {
+	return lexExtendedFile(c, fileName, reader, namedBlocks, from, nil, relPaths...)
+}
+
+// lexExtendedFile is like lexFile, for a file whose blocks are given overrides by the files that extend it.
+func lexExtendedFile(c *compilation,
+	fileName string,
 	reader io.Reader,
 	namedBlocks map[string]namedBlockEntry,
+	from *expansion,
+	overrides map[string][]*blockOverride,
 	relPaths ...string) *lexer {
 
+	e := fileExpansion(fileName)
+	e.overrides = overrides
 	l := &lexer{
+		c:             c,
 		input:         bufio.NewReader(reader),
 		fileName:      fileName,
 		items:         make(chan tokenItem),
 		relativePaths: relPaths,
 		namedBlocks:   namedBlocks, // use named blocks passed in. This will add to the parent map.
+		expansion:     from.expand(e),
 	}
 
 	go func() {
 		// save and restore the include file info
 
 		fp, _ := filepath.Abs(fileName)
-		root := strings.TrimSuffix(filepath.Base(fp), filepath.Ext(fp))
-		for {
-			ext := filepath.Ext(root)
-			if ext == "" {
-				break
-			}
-			root = strings.TrimSuffix(root, ext)
-		}
+		root := fileRoot(fp)
 
 		incPath := namedBlocks[blockIncludePath].text
 		incName := namedBlocks[blockIncludeName].text
 		incRoot := namedBlocks[blockIncludeRoot].text
 		incParent := namedBlocks[blockIncludeParent].text
 
-		namedBlocks[blockIncludePath] = namedBlockEntry{fp, 0, locationRef{}}
-		namedBlocks[blockIncludeName] = namedBlockEntry{filepath.Base(fp), 0, locationRef{}}
-		namedBlocks[blockIncludeRoot] = namedBlockEntry{root, 0, locationRef{}}
-		namedBlocks[blockIncludeParent] = namedBlockEntry{filepath.Base(filepath.Dir(fp)), 0, locationRef{}}
+		namedBlocks[blockIncludePath] = namedBlockEntry{text: fp}
+		namedBlocks[blockIncludeName] = namedBlockEntry{text: filepath.Base(fp)}
+		namedBlocks[blockIncludeRoot] = namedBlockEntry{text: root}
+		namedBlocks[blockIncludeParent] = namedBlockEntry{text: filepath.Base(filepath.Dir(fp))}
 
 		l.run()
 
-		// restore
-		namedBlocks[blockIncludePath] = namedBlockEntry{incPath, 0, locationRef{}}
-		namedBlocks[blockIncludeName] = namedBlockEntry{incName, 0, locationRef{}}
-		namedBlocks[blockIncludeRoot] = namedBlockEntry{incRoot, 0, locationRef{}}
-		namedBlocks[blockIncludeParent] = namedBlockEntry{incParent, 0, locationRef{}}
+		// restore before closing the channel, since the receiver may go on to use the named blocks
+		namedBlocks[blockIncludePath] = namedBlockEntry{text: incPath}
+		namedBlocks[blockIncludeName] = namedBlockEntry{text: incName}
+		namedBlocks[blockIncludeRoot] = namedBlockEntry{text: incRoot}
+		namedBlocks[blockIncludeParent] = namedBlockEntry{text: incParent}
+		close(l.items)
 	}()
 	return l
 }
 
 // lex treats the given string as a block to be inserted
-func lexBlock(blockName string, content string, namedBlocks map[string]namedBlockEntry) *lexer {
+//
+// from is the expansion that the block is substituted from, or nil if it is not being substituted.
+// slots is the content given to the slots of the block by a call tag, or nil if the block is not called.
+func lexBlock(c *compilation, blockName string, content string, namedBlocks map[string]namedBlockEntry, from *expansion, slots map[string]slotContent) *lexer {
+	if slots == nil {
+		slots = make(map[string]slotContent)
+	}
 	l := &lexer{
+		c:           c,
 		input:       bufio.NewReader(strings.NewReader(content)),
 		blockName:   blockName,
 		items:       make(chan tokenItem),
 		namedBlocks: namedBlocks,
+		slots:       slots,
+	}
+	// Look up the block definition now, since sub-lexers may be changing the named blocks while this one emits.
+	if b, ok := l.getNamedBlock(blockName); ok {
+		l.blockRef = b.ref
+	}
+	l.expansion = from.expand(blockExpansion(blockName, l.blockRef))
+
+	go func() {
+		l.run()
+		close(l.items)
+	}()
+	return l
+}
+
+// lexContent scans content that was read somewhere else, such as the content given to a slot, with the surroundings
+// of the lexer that read it. block is the overridable block that the content is in, if any.
+func lexContent(c *compilation, content slotContent, namedBlocks map[string]namedBlockEntry, block *blockTag) *lexer {
+	caller := content.caller
+	l := &lexer{
+		c:             c,
+		input:         bufio.NewReader(strings.NewReader(content.text)),
+		fileName:      caller.fileName,
+		blockName:     caller.blockName,
+		blockRef:      caller.blockRef,
+		lineNum:       content.ref.lineNum,
+		lineRuneNum:   content.ref.offset,
+		items:         make(chan tokenItem),
+		relativePaths: caller.relativePaths,
+		namedBlocks:   namedBlocks,
+		expansion:     caller.expansion,
+		slots:         caller.slots,
+		block:         block,
 	}
 
-	go l.run()
+	go func() {
+		l.run()
+		close(l.items)
+	}()
 	return l
 }
 
+// run lexes the input, sending items to the items channel. The caller is responsible for closing the channel.
 func (l *lexer) run() {
 	for state := lexStart; state != nil; {
 		state = state(l)
 	}
-	close(l.items)
 }
 
 // Starting state. We start in GO mode.
@@ -109,7 +209,11 @@ func lexStart(l *lexer) stateFn {
 
 func lexRun(l *lexer) stateFn {
 	l.acceptRun()
-	l.emitRun()
+	if l.isAtTrimBegin() {
+		l.emitTrimmedRun()
+	} else {
+		l.emitRun()
+	}
 	if l.isAtCloseTag() {
 		l.emitType(itemEnd)
 		l.ignoreCloseTag()
@@ -122,20 +226,21 @@ func lexRun(l *lexer) stateFn {
 	}
 }
 
-func lexParams(l *lexer) stateFn {
+// lexParams emits the parameters of a tag, using split to separate them.
+func (l *lexer) lexParams(split func(string) ([]string, error)) stateFn {
 	l.ignoreSpace()
 
 	l.acceptRun()
 	if !l.isAtCloseTag() {
 		l.emitError("expected closing tag")
-		return nil
+		return l.skipTag()
 	}
 
 	paramString := l.currentString()
-	params, err := splitParams(paramString)
+	params, err := split(paramString)
 	if err != nil {
 		l.emitError(err.Error())
-		return nil
+		return l.skipTag()
 	}
 	for _, p := range params {
 		l.emit(tokenItem{typ: itemParam, val: p})
@@ -145,6 +250,7 @@ func lexParams(l *lexer) stateFn {
 
 // We are pointing to the start of an unknown tag
 func lexTag(l *lexer) stateFn {
+	trim := l.isAtTrimBegin()
 	a := l.acceptTag()
 
 	if a == "" {
@@ -167,16 +273,17 @@ func lexTag(l *lexer) stateFn {
 		if _, ok = l.getNamedBlock(tagName); ok {
 			// it's a defined block, so reset to the name of the block
 			l.putBackCurBuffer()
-			l.next()
-			l.next()
-			l.ignore()
+			l.ignoreOpenTag()
 			i = tokenItem{typ: itemSubstitute}
+		} else if trim {
+			// white space after a trim marker starts a text block, like it does after an open tag
+			l.putBackCurBuffer()
+			l.ignoreOpenTag()
+			i = tokens[tokBegin]
 		} else {
 			// we are going to treat it as a go value
 			l.putBackCurBuffer()
-			l.next()
-			l.next()
-			l.ignore()
+			l.ignoreOpenTag()
 			i = tokenItem{typ: itemInterface, escaped: false, withError: false}
 		}
 	}
@@ -191,6 +298,25 @@ func lexTag(l *lexer) stateFn {
 	case itemSubstitute:
 		return l.lexSubstitute(i.optional)
 
+	case itemCall:
+		return l.lexCall()
+
+	case itemSlot:
+		return l.lexSlot(strings.HasSuffix(a, tokEnd))
+
+	case itemFill:
+		l.emitError("a fill tag must be inside of a call tag")
+		return l.skipTag()
+
+	case itemExtends:
+		return l.lexExtends()
+
+	case itemBlock:
+		return l.lexOverridableBlock()
+
+	case itemSuper:
+		return l.lexSuper()
+
 	case itemStrictBlock:
 		return l.lexStrictBlock()
 
@@ -200,6 +326,10 @@ func lexTag(l *lexer) stateFn {
 	case itemJoin:
 		return l.lexJoin()
 
+	case itemMessage:
+		l.emit(i)
+		return l.lexParams(splitMsgParams)
+
 	default:
 		l.emit(i)
 		if i.typ != itemEnd && i.typ != itemEndBlock {
@@ -219,6 +349,10 @@ func (l *lexer) emit(i tokenItem) {
 		i.val = l.currentString()
 	}
 
+	if i.typ != itemError && (i.typ != itemRun || strings.TrimSpace(i.val) != "") {
+		l.hasOutput = true
+	}
+
 	ref := locationRef{
 		fileName:  l.fileName,
 		blockName: l.blockName,
@@ -229,8 +363,7 @@ func (l *lexer) emit(i tokenItem) {
 
 	// if we are in a block, also add the location of the block to the call stack
 	if l.blockName != "" {
-		b, _ := l.getNamedBlock(l.blockName)
-		i.callStack = append(i.callStack, b.ref)
+		i.callStack = append(i.callStack, l.blockRef)
 	}
 
 	l.items <- i
@@ -244,13 +377,23 @@ func (l *lexer) emitRun() {
 	}
 }
 
+// emitTrimmedRun emits the current run without the white space at its end. It is used before a tag with a trim marker.
+func (l *lexer) emitTrimmedRun() {
+	val := strings.TrimRightFunc(l.currentString(), isWhiteSpace)
+	if val == "" {
+		l.ignore()
+		return
+	}
+	l.emit(tokenItem{typ: itemRun, val: val})
+}
+
 func (l *lexer) lexStrictBlock() stateFn {
 	l.ignoreOneSpace()
 	l.acceptRun()
 	endToken := l.currentString()
 	if !l.isAtCloseTag() {
 		l.emitError("expected close tag")
-		return nil
+		return l.skipTag()
 	}
 	l.ignoreCloseTag()
 	endToken = "{{end " + endToken + "}}"
@@ -270,54 +413,28 @@ func (l *lexer) lexInclude(htmlBreaks bool, escaped bool) stateFn {
 	fileName := strings.TrimSpace(l.currentString())
 	if !l.isAtCloseTag() {
 		l.emitError("expected close tag")
-		return nil // stop
+		return l.skipTag()
 	}
 	l.ignoreCloseTag()
 
-	if fileName[0] == '"' {
+	if fileName != "" && fileName[0] == '"' {
 		var err error
 		if fileName, err = strconv.Unquote(fileName); err != nil {
 			l.emitError("Include file name error: %s", err.Error())
-			return nil // stop
-		}
-	}
-
-	// Assemble the relative paths collected so far
-	var relPath string
-	for _, thisPath := range l.relativePaths {
-		relPath = filepath.Join(relPath, thisPath)
-	}
-
-	// find the file from the include paths, which allows the include paths to override the immediate path
-	var foundPath string
-	if len(includePaths) > 0 {
-		for _, thisPath := range includePaths {
-			fileName2 := filepath.Join(thisPath, relPath, fileName)
-			if fileExists(fileName2) {
-				foundPath = fileName2
-				break
-			}
+			return lexRun
 		}
 	}
-
-	// If not yet found, then find relative to the include file
-	if foundPath == "" {
-		fileName2 := filepath.Join(filepath.Dir(l.fileName), fileName)
-		if fileExists(fileName2) {
-			foundPath = fileName2
-		}
+	if fileName == "" {
+		l.emitError("expected a file name in include tag")
+		return lexRun
 	}
 
-	if foundPath == "" {
-		s := "Could not find include file \"" + fileName + "\""
-		s += " in directories "
-		if len(includePaths) > 0 {
-			s += strings.Join(includePaths, ";") + ":"
-		}
-		s += filepath.Dir(l.fileName)
-		l.emitError(s)
-		return nil
+	foundPath, err := l.findInclude(fileName)
+	if err != nil {
+		l.emitError(err.Error())
+		return lexRun
 	}
+	l.c.addDependency(foundPath)
 
 	if htmlBreaks || escaped {
 		// treat file like a text file
@@ -325,7 +442,7 @@ func (l *lexer) lexInclude(htmlBreaks bool, escaped bool) stateFn {
 		b, err := os.ReadFile(foundPath)
 		if err != nil {
 			l.emitError("error opening include file %s", foundPath)
-			return nil
+			return lexRun
 		}
 		l.emit(tokenItem{typ: itemText, escaped: escaped, withError: false, htmlBreaks: htmlBreaks})
 		l.emit(tokenItem{typ: itemRun, val: string(b)})
@@ -333,36 +450,86 @@ func (l *lexer) lexInclude(htmlBreaks bool, escaped bool) stateFn {
 		return lexRun
 	}
 
-	// lex the include file
-	relPaths := make([]string, len(l.relativePaths), len(l.relativePaths)+1)
-	copy(relPaths, l.relativePaths)
-	curRelPath := path.Dir(fileName)
-	if curRelPath != "" {
-		relPaths = append(relPaths, curRelPath)
+	// only a file that is lexed can include itself, so a text include is not checked for recursion
+	if err := l.checkExpansion(fileExpansion(foundPath)); err != nil {
+		l.emitError(err.Error())
+		return lexRun
 	}
 
+	// lex the include file
 	inFile, err := os.Open(foundPath)
 	if err != nil {
 		l.emitError("Include file error: %s", err.Error())
-		return nil // stop
+		return lexRun
 	}
 	defer func() {
 		_ = inFile.Close()
 	}()
 
-	l2 := lexFile(foundPath, inFile, l.namedBlocks, relPaths...)
+	l2 := lexFile(l.c, foundPath, inFile, l.namedBlocks, l.expansion, l.includeRelPaths(fileName)...)
 
+	// send items as if they are part of current file. Emitting adds where the file was included from to the
+	// call stack of each item, including any errors.
 	for item := range l2.items {
-		l.emit(item) // send items as if they are part of current file
-		if item.typ == itemError {
-			l.emitError("") // add where the file was included from
-			return nil      // stop processing
-		}
+		l.emit(item)
 	}
 
 	return lexRun
 }
 
+// findInclude returns the path of the named file that is included or extended from the file being scanned. The file is
+// looked for in the include paths first, which allows the include paths to override the immediate path, and then
+// relative to the file being scanned.
+func (l *lexer) findInclude(fileName string) (string, error) {
+	// Assemble the relative paths collected so far
+	var relPath string
+	for _, thisPath := range l.relativePaths {
+		relPath = filepath.Join(relPath, thisPath)
+	}
+
+	for _, thisPath := range l.c.includePaths {
+		fileName2 := filepath.Join(thisPath, relPath, fileName)
+		if fileExists(fileName2) {
+			return fileName2, nil
+		}
+	}
+
+	fileName2 := filepath.Join(filepath.Dir(l.fileName), fileName)
+	if fileExists(fileName2) {
+		return fileName2, nil
+	}
+
+	s := "Could not find include file \"" + fileName + "\""
+	s += " in directories "
+	if len(l.c.includePaths) > 0 {
+		s += strings.Join(l.c.includePaths, ";") + ":"
+	}
+	s += filepath.Dir(l.fileName)
+	return "", errors.New(s)
+}
+
+// includeRelPaths returns the relative paths to search for the files included by the named file, which is included
+// from the file being scanned.
+func (l *lexer) includeRelPaths(fileName string) []string {
+	relPaths := make([]string, len(l.relativePaths), len(l.relativePaths)+1)
+	copy(relPaths, l.relativePaths)
+	curRelPath := path.Dir(fileName)
+	if curRelPath != "" {
+		relPaths = append(relPaths, curRelPath)
+	}
+	return relPaths
+}
+
+// endBlockTags returns the tags that can end the named block. The first has no trim marker, and the others
+// have one, as in {{- end name}}.
+func endBlockTags(name string) []string {
+	tags := []string{"{{end " + name + "}}"}
+	for _, ws := range []string{" ", "\t", "\n", "\r\n"} {
+		tags = append(tags, tokTrimBegin+ws+"end "+name+"}}")
+	}
+	return tags
+}
+
 func fileExists(name string) bool {
 	_, err := os.Stat(name)
 	return !errors.Is(err, fs.ErrNotExist)
@@ -374,48 +541,55 @@ func (l *lexer) lexDefineNamedBlock() stateFn {
 
 	if !l.isAtCloseTag() {
 		l.emitError("looking for close tag, found %s", l.peekN(2))
-		return nil
+		return l.skipTag()
 	}
 
 	name := strings.TrimSpace(l.currentString())
 	l.ignoreCloseTag()
 
-	items := strings.Split(name, " ")
+	// after the name comes either the parameter count, or a list of named parameters
 	var paramCount int
-	if len(items) == 2 {
-		var err error
-		name = items[0]
-		paramCount, err = strconv.Atoi(items[1])
-		if err != nil {
-			l.emitError("item after block name must be the parameter count")
-			return nil
+	var params []blockParam
+	if n, paramString, found := strings.Cut(name, " "); found {
+		name = n
+		paramString = strings.TrimSpace(paramString)
+		if count, err := strconv.Atoi(paramString); err == nil {
+			paramCount = count
+		} else if params, err = parseBlockParams(name, paramString); err != nil {
+			l.emitError(err.Error())
+			return l.skipBlock(name)
+		} else {
+			paramCount = len(params)
 		}
-	} else if len(items) > 2 {
-		l.emitError("block name cannot contain spaces")
-		return nil
 	}
 
 	if strings.ContainsAny(name, "\t\r\n") {
 		l.emitError("block name cannot have tabs or newlines after it")
-		return nil
+		return l.skipBlock(strings.Fields(name)[0])
 	}
 
-	if _, ok := tokens["{{"+name]; ok {
+	if isTagName(name) {
 		l.emitError("block name cannot be a tag name. Block name: %s", name)
-		return nil
+		return l.skipBlock(name)
 	}
 
 	endBlock := "{{end " + name + "}}"
 
-	l.acceptUntil(endBlock)
-	if !l.isAt(endBlock) {
+	found := l.acceptUntilAny(endBlockTags(name)...)
+	content := l.currentString()
+	switch found {
+	case "":
 		l.emitError("no end block found for block: " + name)
+		found = endBlock
+	case endBlock:
+	default:
+		content = strings.TrimRightFunc(content, isWhiteSpace)
 	}
-	if err := l.addNamedBlock(name, l.currentString(), paramCount); err != nil {
+	if err := l.addNamedBlock(name, content, paramCount, params); err != nil {
 		l.emitError(err.Error())
-		return nil
+		return l.skipTag()
 	}
-	l.ignoreN(len(endBlock))
+	l.ignoreN(len(found))
 
 	return lexRun
 }
@@ -427,7 +601,7 @@ func (l *lexer) lexSubstitute(optional bool) stateFn {
 
 	if name == "" {
 		l.emitError("expected block name, but got empty value")
-		return nil
+		return l.skipTag()
 	}
 
 	l.ignoreSpace()
@@ -436,7 +610,7 @@ func (l *lexer) lexSubstitute(optional bool) stateFn {
 
 	if !l.isAtCloseTag() {
 		l.emitError("expected close tag")
-		return nil
+		return l.skipTag()
 	}
 
 	l.ignoreCloseTag()
@@ -448,109 +622,747 @@ func (l *lexer) lexSubstitute(optional bool) stateFn {
 	if block, ok = l.getNamedBlock(name); !ok {
 		if !optional {
 			l.emitError("named block not found: %s", name)
-			return nil
 		}
 		return lexRun // else keep going
 	}
 
-	params, err := splitParams(paramString)
+	params, quoted, err := splitBlockParams(paramString)
 	if err != nil {
 		l.emitError(err.Error())
-		return nil
+		return lexRun
 	}
 	// process parameters
-	if processedBlock, err = processParams(name, block, params); err != nil {
+	if processedBlock, err = processParams(name, block, params, quoted); err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+
+	if err = l.checkExpansion(blockExpansion(name, block.ref)); err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+
+	l2 := lexBlock(l.c, name, processedBlock, l.namedBlocks, l.expansion, nil)
+
+	// send items as if they are part of current file, adding where the block was substituted to the call stack
+	for item := range l2.items {
+		l.emit(item)
+	}
+
+	return lexRun
+}
+
+// lexCall scans a call tag, which substitutes a named block like a put tag does, and gives the text up to the
+// matching {{call}} tag to the block as the content of its slots:
+//
+//	{{call layout param1, param2}}
+//	the content of the {{slot}} tag of the block
+//	{{fill header}}the content of the {{slot header}} tag of the block{{fill}}
+//	{{call}}
+func (l *lexer) lexCall() stateFn {
+	l.ignoreSpace()
+	l.acceptUntil1(" \t}{")
+	name := l.currentString()
+
+	if name == "" {
+		l.emitError("expected block name, but got empty value")
+		return l.skipTag()
+	}
+
+	l.ignoreSpace()
+	l.acceptRun()
+	paramString := strings.TrimSpace(l.currentString())
+
+	if !l.isAtCloseTag() {
+		l.emitError("expected close tag")
+		return l.skipTag()
+	}
+	l.ignoreCloseTag()
+
+	slots, err := l.acceptCallContent(name)
+	if err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+
+	block, ok := l.getNamedBlock(name)
+	if !ok {
+		l.emitError("named block not found: %s", name)
+		return lexRun
+	}
+
+	params, quoted, err := splitBlockParams(paramString)
+	if err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+	processedBlock, err := processParams(name, block, params, quoted)
+	if err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+	if err = checkSlots(name, processedBlock, slots); err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+
+	if err = l.checkExpansion(blockExpansion(name, block.ref)); err != nil {
+		l.emitError(err.Error())
+		return lexRun
+	}
+
+	l2 := lexBlock(l.c, name, processedBlock, l.namedBlocks, l.expansion, slots)
+	for item := range l2.items {
+		l.emit(item)
+	}
+
+	return lexRun
+}
+
+// callContentTagRegex matches the call and fill tags that divide up the content of a call tag. The last group is
+// the end of the tag, which is a close tag for an ending tag, or the white space before the name of a starting tag.
+var callContentTagRegex = regexp.MustCompile(`^\{\{(-\s+)?(call|fill)(\}\}|[ \t]+-\}\}|[ \t])`)
+
+// slotTagRegex matches a slot tag in the text of a named block. The group is the name of the slot, if it has one.
+var slotTagRegex = regexp.MustCompile(`\{\{(?:-\s+)?slot(?:[ \t]+([A-Za-z_]\w*))?[ \t]*-?\}\}`)
+
+// acceptCallContent reads the text after a call tag up to its matching {{call}} tag, and returns the content that
+// it gives to each slot. The content of a fill tag goes to the named slot, and the text outside of fill tags goes to
+// the default slot, which has an empty name. Call tags nested in the content are left for the slots to scan.
+func (l *lexer) acceptCallContent(name string) (slots map[string]slotContent, err error) {
+	slots = make(map[string]slotContent)
+	var defaultContent []slotContent
+	var slotName string // the name of the fill tag being read, or empty if not in one
+	depth := 0
+	start := l.currentRef()
+
+	// endContent finishes the text read since start, trimming the white space at its end if trim is true
+	endContent := func(trim bool) slotContent {
+		text := l.currentString()
+		if trim {
+			text = strings.TrimRightFunc(text, isWhiteSpace)
+		}
+		return slotContent{text: text, ref: start, caller: l}
+	}
+
+	for {
+		l.acceptUntil(tokBegin)
+		m := callContentTagRegex.FindStringSubmatch(l.peekN(40))
+		if m == nil {
+			if !l.isAtOpenTag() {
+				return nil, fmt.Errorf("no ending call tag found for block: %s", name)
+			}
+			l.next()
+			l.next()
+			continue
+		}
+		trimBefore, tag, ending := m[1] != "", m[2], strings.HasSuffix(m[3], tokEnd)
+		if tag == "call" && !ending {
+			depth++
+		}
+		if depth > 0 {
+			if tag == "call" && ending {
+				depth--
+			}
+			// leave nested tags in the content
+			for range m[0] {
+				l.next()
+			}
+			continue
+		}
+
+		content := endContent(trimBefore)
+		switch {
+		case tag == "call" && slotName != "":
+			return nil, fmt.Errorf("expected ending fill tag for slot %s in call of block %s", slotName, name)
+		case tag == "call":
+			defaultContent = append(defaultContent, content)
+		case ending && slotName == "":
+			return nil, fmt.Errorf("unexpected ending fill tag in call of block %s", name)
+		case ending:
+			slots[slotName] = content
+			slotName = ""
+		case slotName != "":
+			return nil, fmt.Errorf("expected ending fill tag for slot %s in call of block %s", slotName, name)
+		default:
+			defaultContent = append(defaultContent, content)
+		}
+
+		l.ignoreN(len(m[0]) - len(m[3]))
+		if !ending {
+			// read the name of the slot
+			l.ignoreSpace()
+			l.acceptRun()
+			slotName = strings.TrimSpace(l.currentString())
+			if !identifierRegex.MatchString(slotName) {
+				return nil, fmt.Errorf("expected a slot name in fill tag, got: %q", slotName)
+			}
+			if _, ok := slots[slotName]; ok {
+				return nil, fmt.Errorf("duplicate fill tag for slot %s in call of block %s", slotName, name)
+			}
+			if !l.isAtCloseTag() {
+				return nil, fmt.Errorf("expected close tag")
+			}
+		}
+		l.ignoreCloseTag()
+		start = l.currentRef()
+
+		if tag == "call" {
+			break
+		}
+	}
+
+	// The default content can come before, between or after fill tags, but only one part of it can have more than white space.
+	for _, content := range defaultContent {
+		if len(defaultContent) == 1 || strings.TrimSpace(content.text) != "" {
+			if _, ok := slots[""]; ok {
+				return nil, fmt.Errorf("the content of the call of block %s that is not in a fill tag must be in one place", name)
+			}
+			slots[""] = content
+		}
+	}
+	return
+}
+
+// checkSlots returns an error if a call tag gives content to a slot that the text of the named block does not have.
+// White space given to the default slot is ignored.
+func checkSlots(blockName string, text string, slots map[string]slotContent) error {
+	found := make(map[string]bool)
+	for _, m := range slotTagRegex.FindAllStringSubmatch(text, -1) {
+		found[m[1]] = true
+	}
+	for name, content := range slots {
+		if found[name] {
+			continue
+		}
+		if name == "" {
+			if strings.TrimSpace(content.text) != "" {
+				return fmt.Errorf("block %s has no slot tag for the content of the call", blockName)
+			}
+			continue
+		}
+		return fmt.Errorf("block %s has no slot named %s", blockName, name)
+	}
+	return nil
+}
+
+// lexSlot scans a slot tag, which substitutes the content that a call tag gave to a slot of the block being scanned.
+// A slot that was given no content is left blank. closed is true if the tag has already been closed, as in {{slot}}.
+func (l *lexer) lexSlot(closed bool) stateFn {
+	var name string
+	if closed {
+		l.ignore()
+	} else {
+		l.ignoreSpace()
+		l.acceptRun()
+		name = strings.TrimSpace(l.currentString())
+		if !l.isAtCloseTag() {
+			l.emitError("expected close tag")
+			return l.skipTag()
+		}
+		l.ignoreCloseTag()
+		if !identifierRegex.MatchString(name) {
+			l.emitError("expected a slot name in slot tag, got: %q", name)
+			return lexRun
+		}
+	}
+
+	if l.slots == nil {
+		l.emitError("a slot tag must be inside of a named block")
+		return lexRun
+	}
+	content, ok := l.slots[name]
+	if !ok {
+		return lexRun
+	}
+
+	l2 := lexContent(l.c, content, l.namedBlocks, content.caller.block)
+	for item := range l2.items {
+		l.emit(item)
+	}
+	return lexRun
+}
+
+// lexExtends scans an extends tag, which makes the file an extension of another file. The rest of the file gives
+// content to the blocks of the other file, which is then scanned in place of the file:
+//
+//	{{extends "base.tpl.got"}}
+//	{{block title}}My Page{{end title}}
+func (l *lexer) lexExtends() stateFn {
+	l.ignore()
+	l.acceptRun()
+	fileName := strings.TrimSpace(l.currentString())
+	if !l.isAtCloseTag() {
+		l.emitError("expected close tag")
+		return l.skipTag()
+	}
+	ref := l.currentRef()
+	l.ignoreCloseTag()
+
+	if l.hasOutput {
+		l.emitError("an extends tag must come before anything that the file outputs")
+		return lexRun
+	}
+	if fileName != "" && fileName[0] == '"' {
+		var err error
+		if fileName, err = strconv.Unquote(fileName); err != nil {
+			l.emitError("Extends file name error: %s", err.Error())
+			return lexRun
+		}
+	}
+	if fileName == "" {
+		l.emitError("expected a file name in extends tag")
+		return lexRun
+	}
+
+	overrides := l.acceptOverrides()
+
+	// The files that extend this one come first, so that their content overrides the content given here.
+	merged := make(map[string][]*blockOverride)
+	for name, chain := range l.expansion.blockOverrideMap() {
+		merged[name] = append([]*blockOverride(nil), chain...)
+	}
+	for _, o := range overrides {
+		merged[o.name] = append(merged[o.name], o)
+	}
+
+	foundPath, err := l.findInclude(fileName)
+	if err != nil {
+		l.emitError(err.Error())
+		return nil
+	}
+	l.c.addDependency(foundPath)
+	if err = l.checkExpansion(fileExpansion(foundPath)); err != nil {
 		l.emitError(err.Error())
 		return nil
 	}
+	inFile, err := os.Open(foundPath)
+	if err != nil {
+		l.emitError("Extends file error: %s", err.Error())
+		return nil
+	}
+	defer func() {
+		_ = inFile.Close()
+	}()
 
-	l2 := lexBlock(name, processedBlock, l.namedBlocks)
+	l2 := lexExtendedFile(l.c, foundPath, inFile, l.namedBlocks, l.expansion, merged, l.includeRelPaths(fileName)...)
 
+	// send the items of the extended file as if the file was included where the extends tag is
+	l.lineNum, l.lineRuneNum = ref.lineNum, ref.offset
 	for item := range l2.items {
-		l.emit(item) // send items as if they are part of current file
-		if item.typ == itemError {
-			l.emitError("") // add where the item was included from
-			return nil      // stop processing
+		l.emit(item)
+	}
+
+	for _, o := range overrides {
+		if !o.used {
+			l.lineNum, l.lineRuneNum = o.content.ref.lineNum, o.content.ref.offset
+			l.emitError("block %s is not in %s", o.name, fileName)
+		}
+	}
+	return nil
+}
+
+// acceptOverrides reads the rest of a file after an extends tag, and returns the blocks that it overrides. Besides block
+// tags, only white space, comments and named block definitions can come after an extends tag.
+func (l *lexer) acceptOverrides() (overrides []*blockOverride) {
+	const msg = "only block tags, comments and named block definitions can come after an extends tag"
+	for {
+		l.acceptWhiteSpace()
+		l.ignore()
+		if r := l.peek(); r == eof || r == errRune {
+			return
+		}
+		if !l.isAtOpenTag() {
+			l.emitError(msg)
+			l.acceptUntil(tokBegin)
+			l.ignore()
+			continue
+		}
+
+		a := l.acceptTag()
+		switch tokens[a].typ {
+		case itemBlock:
+			name, content, ok := l.acceptBlockContent()
+			if !ok {
+				continue
+			}
+			for _, o := range overrides {
+				if o.name == name {
+					l.emitError("duplicate block: %s", name)
+					ok = false
+				}
+			}
+			if ok {
+				overrides = append(overrides, &blockOverride{name: name, content: content})
+			}
+		case itemNamedBlock:
+			l.lexDefineNamedBlock()
+		case itemComment:
+			l.lexComment()
+		default:
+			l.emitError(msg)
+			if !strings.HasSuffix(a, tokEnd) {
+				l.skipTag()
+			}
+		}
+	}
+}
+
+// acceptBlockContent reads the name of a block tag, and its content up to its end tag.
+func (l *lexer) acceptBlockContent() (name string, content slotContent, ok bool) {
+	l.ignoreSpace()
+	l.acceptRun()
+	name = strings.TrimSpace(l.currentString())
+	if !l.isAtCloseTag() {
+		l.emitError("looking for close tag, found %s", l.peekN(2))
+		l.skipTag()
+		return
+	}
+	l.ignoreCloseTag()
+	if name == "" {
+		l.emitError("expected block name, but got empty value")
+		return
+	}
+	if strings.ContainsAny(name, " \t\r\n") {
+		l.emitError("block name cannot contain spaces")
+		l.skipBlock(strings.Fields(name)[0])
+		return
+	}
+
+	found := l.acceptUntilAny(endBlockTags(name)...)
+	content = slotContent{text: l.currentString(), ref: l.currentRef(), caller: l}
+	switch found {
+	case "":
+		l.emitError("no end block found for block: " + name)
+		return
+	case "{{end " + name + "}}":
+	default:
+		content.text = strings.TrimRightFunc(content.text, isWhiteSpace)
+	}
+	l.ignoreN(len(found))
+	return name, content, true
+}
+
+// blockTagRegex matches a block tag. The group is the name of the block.
+var blockTagRegex = regexp.MustCompile(`\{\{(?:-\s+)?block[ \t]+(\S+?)[ \t]*-?\}\}`)
+
+// lexOverridableBlock scans a block tag, which outputs its content, unless a file that extends the file being scanned
+// gives the block other content.
+func (l *lexer) lexOverridableBlock() stateFn {
+	name, content, ok := l.acceptBlockContent()
+	if !ok {
+		return lexRun
+	}
+
+	var contents []slotContent
+	for _, o := range l.expansion.blockOverrides(name) {
+		o.used = true
+		contents = append(contents, o.content)
+	}
+	contents = append(contents, content)
+
+	// The blocks inside of content that is overridden can be overridden too, even though they will not be scanned.
+	for _, c := range contents[1:] {
+		for _, m := range blockTagRegex.FindAllStringSubmatch(c.text, -1) {
+			for _, o := range c.caller.expansion.blockOverrides(m[1]) {
+				o.used = true
+			}
 		}
 	}
 
+	l2 := lexContent(l.c, contents[0], l.namedBlocks, &blockTag{name: name, supers: contents[1:]})
+	for item := range l2.items {
+		l.emit(item)
+	}
 	return lexRun
 }
 
-func processParams(name string, in namedBlockEntry, params []string) (out string, err error) {
-	out = in.text
+// lexSuper scans a super tag, which outputs the content that the content of the block being scanned overrides.
+func (l *lexer) lexSuper() stateFn {
+	l.ignore()
+	if l.block == nil {
+		l.emitError("a super tag must be inside of a block tag")
+		return lexRun
+	}
+	if len(l.block.supers) == 0 {
+		l.emitError("block %s does not override any content for a super tag to output", l.block.name)
+		return lexRun
+	}
 
-	var i int
-	var s string
+	l2 := lexContent(l.c, l.block.supers[0], l.namedBlocks, &blockTag{name: l.block.name, supers: l.block.supers[1:]})
+	for item := range l2.items {
+		l.emit(item)
+	}
+	return lexRun
+}
 
-	if len(params) == 1 &&
-		params[0] == "" &&
-		in.paramCount == 0 {
-		out = in.text
+// blockOverrideMap returns the overrides of the blocks of the nearest file being expanded that is extended, or nil
+// if none is.
+func (e *expansion) blockOverrideMap() map[string][]*blockOverride {
+	for cur := e; cur != nil; cur = cur.parent {
+		if cur.overrides != nil {
+			return cur.overrides
+		}
+	}
+	return nil
+}
+
+// blockOverrides returns the contents given to the named block by the files that extend the nearest file being
+// expanded that is extended.
+func (e *expansion) blockOverrides(name string) []*blockOverride {
+	return e.blockOverrideMap()[name]
+}
+
+// blockParamRefRegex matches a reference to a parameter inside a named block, either by its position, as in $1,
+// or by its name, as in $title.
+var blockParamRefRegex = regexp.MustCompile(`\$(\d+|[A-Za-z_]\w*)`)
+
+// blockKeywordRegex matches a parameter given by name where a named block is substituted, as in title="Hi".
+var blockKeywordRegex = regexp.MustCompile(`^([A-Za-z_]\w*)\s*=([^=].*)$`)
+
+// parseBlockParams parses the named parameters in the definition of a named block, as in:
+//
+//	{{define card title, body="(none)"}}
+//
+// A parameter with a default value is optional, and one without is required.
+func parseBlockParams(blockName string, paramString string) (params []blockParam, err error) {
+	items, quoted, err := splitBlockParams(paramString)
+	if err != nil {
 		return
 	}
+	for i, item := range items {
+		var p blockParam
+		if quoted[i] {
+			return nil, fmt.Errorf("expected a parameter name or name=default in the definition of block %s, got: %q", blockName, item)
+		}
+		if m := blockKeywordRegex.FindStringSubmatch(item); m != nil {
+			p.name = m[1]
+			p.hasDefault = true
+			if p.value, err = unquoteParam(m[2]); err != nil {
+				return nil, fmt.Errorf("the default value of parameter %s of block %s is not a valid string: %s", p.name, blockName, m[2])
+			}
+		} else if identifierRegex.MatchString(item) {
+			p.name = item
+		} else {
+			return nil, fmt.Errorf("expected a parameter name or name=default in the definition of block %s, got: %q", blockName, item)
+		}
+		for _, p2 := range params {
+			if p2.name == p.name {
+				return nil, fmt.Errorf("duplicate parameter in the definition of block %s: %s", blockName, p.name)
+			}
+		}
+		params = append(params, p)
+	}
+	return
+}
+
+// unquoteParam returns the value of a parameter given as a quoted string, or the parameter itself if it is not quoted.
+func unquoteParam(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s != "" && (s[0] == '"' || s[0] == '`') {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
+// processParams returns the text of a named block with the given parameters substituted for the references to them.
+// quoted reports which of the parameters were quoted.
+func processParams(name string, in namedBlockEntry, params []string, quoted []bool) (out string, err error) {
+	if len(params) == 1 &&
+		params[0] == "" {
+		params = nil
+	}
+	if in.params != nil {
+		return processNamedParams(name, in, params, quoted)
+	}
 	if len(params) > in.paramCount {
 		err = fmt.Errorf("too many parameters given for block %s: max %d, got %d", name, in.paramCount, len(params))
 		return
 	}
 
-	for i, s = range params {
-		search := fmt.Sprintf("$%d", i+1)
-		out = strings.Replace(out, search, s, -1)
+	// the parameters that are not given are filled in with blanks
+	values := make([]string, in.paramCount)
+	copy(values, params)
+	out = substituteParams(in.text, func(ref string) (string, bool) {
+		if i, err2 := strconv.Atoi(ref); err2 == nil && i >= 1 && i <= len(values) {
+			return values[i-1], true
+		}
+		return "", false
+	})
+	return
+}
+
+// processNamedParams substitutes the parameters of a block that was defined with named parameters. Parameters can be given
+// in order, then by name. A parameter that is not given gets its default value, and it is an error to leave out a
+// parameter that has no default. A quoted parameter is always given by position.
+func processNamedParams(name string, in namedBlockEntry, params []string, quoted []bool) (out string, err error) {
+	values := make([]string, len(in.params))
+	given := make([]bool, len(in.params))
+	var byName bool
+	var pos int
+	for j, param := range params {
+		if m := blockKeywordRegex.FindStringSubmatch(param); m != nil && !quoted[j] {
+			i := in.paramIndex(m[1])
+			if i < 0 {
+				return "", fmt.Errorf("block %s has no parameter named %s", name, m[1])
+			}
+			if given[i] {
+				return "", fmt.Errorf("parameter %s given more than once for block %s", m[1], name)
+			}
+			if values[i], err = unquoteParam(m[2]); err != nil {
+				return "", fmt.Errorf("the value of parameter %s of block %s is not a valid string: %s", m[1], name, m[2])
+			}
+			given[i] = true
+			byName = true
+			continue
+		}
+		if byName {
+			return "", fmt.Errorf("parameters given by position must come before parameters given by name for block %s", name)
+		}
+		if pos >= len(in.params) {
+			return "", fmt.Errorf("too many parameters given for block %s: max %d, got %d", name, len(in.params), len(params))
+		}
+		values[pos] = param
+		given[pos] = true
+		pos++
 	}
 
-	// fill in with blanks the remaining parameters
-	if i < in.paramCount-1 {
-		for j := i + 1; j < in.paramCount; j++ {
-			search := fmt.Sprintf("$%d", j+1)
-			out = strings.Replace(out, search, "", -1)
+	for i, p := range in.params {
+		if given[i] {
+			continue
+		}
+		if !p.hasDefault {
+			return "", fmt.Errorf("missing parameter %s for block %s", p.name, name)
 		}
+		values[i] = p.value
 	}
 
+	out = substituteParams(in.text, func(ref string) (string, bool) {
+		if i, err2 := strconv.Atoi(ref); err2 == nil {
+			if i >= 1 && i <= len(values) {
+				return values[i-1], true
+			}
+		} else if i = in.paramIndex(ref); i >= 0 {
+			return values[i], true
+		}
+		return "", false
+	})
 	return
 }
 
+// substituteParams replaces each reference to a parameter in text with the value that lookup returns for it. A reference
+// is replaced as a whole, so that $10 is not mistaken for $1 followed by a 0, and a reference that lookup does not know
+// is left as is.
+func substituteParams(text string, lookup func(ref string) (string, bool)) string {
+	return blockParamRefRegex.ReplaceAllStringFunc(text, func(ref string) string {
+		if v, ok := lookup(ref[1:]); ok {
+			return v
+		}
+		return ref
+	})
+}
+
+// paramIndex returns the index of the named parameter, or -1 if the block has no parameter with that name.
+func (b namedBlockEntry) paramIndex(name string) int {
+	for i, p := range b.params {
+		if p.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
 // TODO: Test empty params
+
+// splitParams splits the comma separated parameters of a tag. The tokens of each parameter are joined without
+// the white space between them, and a quoted parameter is unquoted.
 func splitParams(paramString string) (params []string, err error) {
+	params, _, err = scanParams(paramString, false, false)
+	return
+}
+
+// splitBlockParams splits the parameters given to a named block like splitParams does, and also reports which of the
+// parameters were quoted, since a quoted parameter is always given by position, even if it looks like name=value.
+func splitBlockParams(paramString string) (params []string, quoted []bool, err error) {
+	return scanParams(paramString, false, false)
+}
+
+// splitJoinParams splits the parameters of a join tag. It is like splitParams, but keeps a space between tokens that
+// were separated by white space, so that a parameter can be a loop clause, as in "v in items".
+func splitJoinParams(paramString string) (params []string, err error) {
+	params, _, err = scanParams(paramString, true, false)
+	return
+}
+
+// splitMsgParams splits the parameters of a msg tag. It is like splitJoinParams, but a comma inside of parentheses,
+// brackets or braces does not separate parameters, so that a value can be a Go call, as in name=f(a, b).
+func splitMsgParams(paramString string) (params []string, err error) {
+	params, _, err = scanParams(paramString, true, true)
+	return
+}
+
+// scanParams does the work of splitParams, splitBlockParams, splitJoinParams and splitMsgParams.
+func scanParams(paramString string, keepSpaces bool, nested bool) (params []string, quoted []bool, err error) {
 	var currentItem string
 
 	var s scanner.Scanner
 	s.Init(strings.NewReader(paramString))
+	end := 0   // the offset of the end of the previous token
+	depth := 0 // when nested, commas inside of parentheses, brackets and braces do not separate parameters
 	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
 		text := s.TokenText()
+		if nested {
+			switch text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				depth--
+			}
+		}
+		if keepSpaces && s.Position.Offset > end && currentItem != "" && text != "," {
+			currentItem += " "
+		}
+		end = s.Pos().Offset
 		if len(text) > 0 && text[0] == '"' && (len(text) == 1 || text[len(text)-1] != '"') {
 			err = fmt.Errorf("parameter has a beginning quote with no ending quote: %s", text)
 			return
 		}
-		if text == "," {
+		if text == "," && depth <= 0 {
 			currentItem = strings.TrimSpace(currentItem)
 			if currentItem != "" {
-				if currentItem[0] == '"' {
+				isQuoted := currentItem[0] == '"'
+				if isQuoted {
 					currentItem, err = strconv.Unquote(currentItem)
 					if err != nil {
 						return
 					}
 				}
 				params = append(params, currentItem)
+				quoted = append(quoted, isQuoted)
 				currentItem = ""
 			} else {
 				// insert a blank item
 				params = append(params, currentItem)
+				quoted = append(quoted, false)
 			}
 		} else {
 			currentItem += text
 		}
 	}
+	currentItem = strings.TrimSpace(currentItem)
 	if currentItem != "" {
-		if currentItem[0] == '"' {
+		isQuoted := currentItem[0] == '"'
+		if isQuoted {
 			currentItem, err = strconv.Unquote(currentItem)
 			if err != nil {
 				return
 			}
 		}
 		params = append(params, currentItem)
+		quoted = append(quoted, isQuoted)
 	} else {
 		params = append(params, currentItem)
+		quoted = append(quoted, false)
 	}
 
 	return
@@ -561,7 +1373,7 @@ func (l *lexer) lexComment() stateFn {
 
 	if !l.isAtCloseTag() {
 		l.emitError("close tag not found")
-		return nil
+		return l.skipTag()
 	}
 	l.ignoreCloseTag()
 	return lexRun
@@ -569,7 +1381,7 @@ func (l *lexer) lexComment() stateFn {
 
 func (l *lexer) lexJoin() stateFn {
 	l.emitType(itemJoin)
-	return lexParams
+	return l.lexParams(splitJoinParams)
 }
 
 // emitError emits an error token
@@ -577,6 +1389,91 @@ func (l *lexer) emitError(format string, args ...interface{}) {
 	l.emit(tokenItem{typ: itemError, val: fmt.Sprintf(format, args...)})
 }
 
+// fileExpansion returns the expansion for lexing the named file.
+func fileExpansion(fileName string) expansion {
+	fp, _ := filepath.Abs(fileName)
+	return expansion{desc: "file " + fileName, key: "file " + fp}
+}
+
+// blockExpansion returns the expansion for lexing the named block that was defined at ref.
+// Blocks are identified by where they were defined, rather than just by name, since a block
+// may redefine a block with the same name and then substitute it.
+func blockExpansion(name string, ref locationRef) expansion {
+	return expansion{
+		desc: "block " + name,
+		key:  fmt.Sprintf("block %s %s:%s:%d:%d", name, ref.fileName, ref.blockName, ref.lineNum, ref.offset),
+	}
+}
+
+// expand returns the expansion e nested inside of parent. parent may be nil.
+func (parent *expansion) expand(e expansion) *expansion {
+	e.parent = parent
+	if parent != nil {
+		e.depth = parent.depth + 1
+	}
+	return &e
+}
+
+// checkExpansion returns an error if expanding e from the current lexer would expand a block or
+// file inside of itself, which would never end, or would nest expansions too deeply.
+func (l *lexer) checkExpansion(e expansion) error {
+	chain := []string{e.desc}
+	for cur := l.expansion; cur != nil; cur = cur.parent {
+		chain = append([]string{cur.desc}, chain...)
+		if cur.key == e.key {
+			return fmt.Errorf("infinite recursion: %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	max := l.c.maxExpansionDepth
+	if max == 0 {
+		max = defaultMaxExpansionDepth
+	}
+	if max > 0 && l.expansion != nil && l.expansion.depth+1 > max {
+		return fmt.Errorf("named blocks and include files are nested more than %d deep: %s", max, strings.Join(chain, " -> "))
+	}
+	return nil
+}
+
+// skipTag is used to recover from an error inside a tag. It skips to just after the close tag that ends
+// the current tag, skipping over any tags nested inside it, and then continues lexing from there.
+func (l *lexer) skipTag() stateFn {
+	depth := 0
+	for {
+		if l.isAtOpenTag() {
+			l.next()
+			l.next()
+			depth++
+		} else if n := l.closeTagLen(); n > 0 {
+			for i := 0; i < n; i++ {
+				l.next()
+			}
+			if depth == 0 {
+				l.ignore()
+				return lexRun
+			}
+			depth--
+		} else if r := l.next(); r == eof || r == errRune {
+			l.ignore()
+			return nil
+		}
+	}
+}
+
+// skipBlock is used to recover from an error in the tag that starts a named block. It skips past the end of the
+// named block if it can be found, and otherwise continues lexing from the current position.
+func (l *lexer) skipBlock(name string) stateFn {
+	l.ignore()
+	endBlock := "{{end " + name + "}}"
+	l.acceptUntil(endBlock)
+	if l.isAt(endBlock) {
+		l.ignoreN(len(endBlock))
+	} else {
+		l.putBackCurBuffer()
+	}
+	return lexRun
+}
+
 // isSpace reports whether r is a space character.
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
@@ -609,9 +1506,34 @@ func (l *lexer) isAtOpenTag() bool {
 	return l.isAt(tokBegin)
 }
 
-// Test if we are at a close tag.
+// Test if we are at a close tag, including a close tag with a trim marker.
 func (l *lexer) isAtCloseTag() bool {
-	return l.isAt(tokEnd)
+	return l.closeTagLen() > 0
+}
+
+// closeTagLen returns the number of runes in the close tag we are at, or zero if we are not at a close tag.
+// A close tag with a trim marker is a white space character followed by "-}}".
+func (l *lexer) closeTagLen() int {
+	if l.isAt(tokEnd) {
+		return len(tokEnd)
+	}
+	if l.isAtTrimEnd() {
+		return 1 + len(tokTrimEnd)
+	}
+	return 0
+}
+
+// isAtTrimBegin tests if we are at an open tag with a trim marker. The dash of the trim marker must be followed by
+// white space, so that a tag like {{-x}} is still a negative value.
+func (l *lexer) isAtTrimBegin() bool {
+	t := []rune(l.peekN(len(tokTrimBegin) + 1))
+	return len(t) == len(tokTrimBegin)+1 && string(t[:len(tokTrimBegin)]) == tokTrimBegin && isWhiteSpace(t[len(tokTrimBegin)])
+}
+
+// isAtTrimEnd tests if we are at a close tag with a trim marker.
+func (l *lexer) isAtTrimEnd() bool {
+	t := []rune(l.peekN(1 + len(tokTrimEnd)))
+	return len(t) == 1+len(tokTrimEnd) && isWhiteSpace(t[0]) && string(t[1:]) == tokTrimEnd
 }
 
 func (l *lexer) isAt(pattern string) bool {
@@ -672,6 +1594,29 @@ func (l *lexer) acceptUntil(pattern string) {
 	}
 }
 
+// acceptUntilAny will accept runes until it encounters one of the patterns, or eof or err.
+// It returns the pattern found, or an empty string if none was found.
+func (l *lexer) acceptUntilAny(patterns ...string) string {
+	var n int
+	for _, p := range patterns {
+		if len(p) > n {
+			n = len(p)
+		}
+	}
+	for {
+		s := l.peekN(n)
+		if s == "" {
+			return ""
+		}
+		for _, p := range patterns {
+			if strings.HasPrefix(s, p) {
+				return p
+			}
+		}
+		l.next()
+	}
+}
+
 // acceptUntil1 accepts runes until one of the runes in the terminators string is found
 func (l *lexer) acceptUntil1(terminators string) {
 	for strings.IndexRune(terminators, l.next()) < 0 {
@@ -684,11 +1629,26 @@ func (l *lexer) acceptTag() (ret string) {
 	if !l.isAtOpenTag() {
 		return ""
 	}
+	trim := l.isAtTrimBegin()
 	ret += string(l.next())
 	ret += string(l.next())
+	if trim {
+		// a trim marker and the white space after it, which are not part of the tag name
+		l.next()
+		l.acceptWhiteSpace()
+	}
 	var foundOne bool
 
 	for {
+		if foundOne && l.isAtTrimEnd() {
+			// a tag like {{else -}}, so step over the close tag and the white space it trims
+			for i := 0; i < 1+len(tokTrimEnd); i++ {
+				l.next()
+			}
+			l.acceptWhiteSpace()
+			ret += tokEnd
+			return
+		}
 		r := l.next()
 		if r == '}' && foundOne {
 			// accept two contiguous closing chars as part of the tag, as long as there is a value
@@ -784,6 +1744,9 @@ func (l *lexer) ignoreRun() {
 func (l *lexer) ignoreSpace() {
 	l.ignore()
 	for {
+		if l.isAtTrimEnd() {
+			return // the space is part of the close tag
+		}
 		r := l.next()
 		switch {
 		case r == eof:
@@ -859,11 +1822,39 @@ func (l *lexer) ignoreNewline() {
 	}
 }
 
+// ignoreCloseTag steps over a close tag. If the close tag has a trim marker, the white space after it is also ignored.
 func (l *lexer) ignoreCloseTag() {
-	if l.isAtCloseTag() {
-		l.next()
+	if l.isAt(tokEnd) {
+		l.ignoreN(len(tokEnd))
+	} else if l.isAtTrimEnd() {
+		l.ignoreN(1 + len(tokTrimEnd))
+		l.ignoreWhiteSpace()
+	}
+}
+
+// ignoreOpenTag steps over an open tag, and its trim marker if it has one.
+func (l *lexer) ignoreOpenTag() {
+	trim := l.isAtTrimBegin()
+	l.next()
+	l.next()
+	if trim {
 		l.next()
-		l.ignore()
+		l.acceptWhiteSpace()
+	}
+	l.ignore()
+}
+
+// acceptWhiteSpace accepts white space, including newlines.
+func (l *lexer) acceptWhiteSpace() {
+	for {
+		r := l.next()
+		if r == eof || r == errRune {
+			return
+		}
+		if !isWhiteSpace(r) {
+			l.backup()
+			return
+		}
 	}
 }
 
@@ -886,11 +1877,21 @@ func (l *lexer) currentLen() int {
 	return len(l.curBuffer)
 }
 
-func (l *lexer) addNamedBlock(name string, text string, paramCount int) error {
+// isTagName returns true if name is the name of a tag, like if, or default in {{default}}. A named block cannot have
+// the name of a tag, since the tag would be used wherever the block is.
+func isTagName(name string) bool {
+	if _, ok := tokens["{{"+name]; ok {
+		return true
+	}
+	_, ok := tokens["{{"+name+tokEnd]
+	return ok
+}
+
+func (l *lexer) addNamedBlock(name string, text string, paramCount int, params []blockParam) error {
 	if l.namedBlocks == nil {
 		l.namedBlocks = make(map[string]namedBlockEntry)
 	}
-	l.namedBlocks[name] = namedBlockEntry{text, paramCount, locationRef{
+	l.namedBlocks[name] = namedBlockEntry{text, paramCount, params, locationRef{
 		fileName:  l.fileName,
 		blockName: l.blockName,
 		lineNum:   l.lineNum,
@@ -899,6 +1900,16 @@ func (l *lexer) addNamedBlock(name string, text string, paramCount int) error {
 	return nil
 }
 
+// currentRef returns the location of the start of the current buffer.
+func (l *lexer) currentRef() locationRef {
+	return locationRef{
+		fileName:  l.fileName,
+		blockName: l.blockName,
+		lineNum:   l.lineNum,
+		offset:    l.lineRuneNum,
+	}
+}
+
 func (l *lexer) getNamedBlock(name string) (block namedBlockEntry, ok bool) {
 	block, ok = l.namedBlocks[name]
 	return
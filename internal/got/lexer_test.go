@@ -3,7 +3,10 @@ package got
 import (
 	"bufio"
 	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -34,6 +37,9 @@ func TestSplitParams(t *testing.T) {
 		{"empty space param", `test1, ,test2`, []string{`test1`, "", "test2"}},
 		{"space param", `test1," " ,test2`, []string{`test1`, " ", "test2"}},
 		{"3 empty param", `,,`, []string{"", "", ""}},
+		{"space in param", `Hello World, x y`, []string{"HelloWorld", "xy"}},
+		{"comma in parens", `f(x, y)`, []string{"f(x", "y)"}},
+		{"stray paren", `a (b, c, d`, []string{"a(b", "c", "d"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -44,6 +50,44 @@ func TestSplitParams(t *testing.T) {
 	}
 }
 
+func TestSplitJoinParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"space in param", `v in items, "-"`, []string{"v in items", "-"}},
+		{"spaces in param", "a   +\tb,c", []string{"a + b", "c"}},
+		{"no space", "a+b", []string{"a+b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := splitJoinParams(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitJoinParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMsgParams(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"call", `name=f(a, b), count=n`, []string{"name=f(a, b)", "count=n"}},
+		{"nested", `x=m[g(a, b)], y={1, 2}`, []string{"x=m[g(a, b)]", "y={1, 2}"}},
+		{"quoted", `id="a, (b"`, []string{`id="a, (b"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := splitMsgParams(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMsgParams() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSplitParamsError(t *testing.T) {
 	type test struct {
 		name  string
@@ -397,7 +441,7 @@ func Test_lexer_peek(t *testing.T) {
 }
 
 func runBlockLexer(content string) (ret []tokenItem, l *lexer) {
-	l = lexBlock("test", content, nil)
+	l = lexBlock(newCompilation(nil), "test", content, nil, nil, nil)
 
 	for tok := range l.items {
 		ret = append(ret, tok)
@@ -423,12 +467,12 @@ func Test_lexTypes(t *testing.T) {
 		{"go with text", "{{g abc {{ 123 }} }}", []tokenType{itemGo, itemRun, itemText, itemRun, itemEnd, itemRun, itemEnd}},
 		{"go value", "{{abc}}", []tokenType{itemInterface, itemRun, itemEnd}},
 		{"strict block", "{{begin abc}} 123 {{g }} {{end abc}}", []tokenType{itemStrictBlock}},
-		{"strict block error 1", "{{begin abc {{sf}} }} 123 {{g }} {{end abc}}", []tokenType{itemError}},
+		{"strict block error 1", "{{begin abc {{sf}} }} 123 {{g }} {{end abc}}", []tokenType{itemError, itemRun, itemGo, itemEnd, itemRun, itemInterface, itemRun, itemEnd}},
 		{"strict block error 2", "{{begin abc}} 123 {{g }} {{end abcd}}", []tokenType{itemError}},
 		{"comment", "{{// adfaf }}abc", []tokenType{itemRun}},
 		{"join", "{{join a, b }}c{{join}}", []tokenType{itemJoin, itemParam, itemParam, itemEnd, itemRun, itemEndBlock}},
-		{"join error", "{{join a,\"b }}c{{join}}", []tokenType{itemJoin, itemError}},
-		{"join error 2", "{{join a,b {{d}} }}c{{join}}", []tokenType{itemJoin, itemError}},
+		{"join error", "{{join a,\"b }}c{{join}}", []tokenType{itemJoin, itemError, itemRun, itemEndBlock}},
+		{"join error 2", "{{join a,b {{d}} }}c{{join}}", []tokenType{itemJoin, itemError, itemRun, itemEndBlock}},
 		{"if", "{{if a>b}}c{{if}}", []tokenType{itemIf, itemRun, itemEnd, itemRun, itemEndBlock}},
 		{"else", "{{if a>b }}c{{else}}d{{if}}", []tokenType{itemIf, itemRun, itemEnd, itemRun, itemEndBlock, itemRun, itemEndBlock}},
 		{"elseif", "{{if a>b }}c{{elseif c<d}}d{{if}}", []tokenType{itemIf, itemRun, itemEnd, itemRun, itemEndBlock, itemRun, itemEnd, itemRun, itemEndBlock}},
@@ -482,6 +526,19 @@ func Test_lexBlocks(t *testing.T) {
 	assert.Equal(t, "\n456\n", l.namedBlocks["def"].text)
 	assert.Equal(t, 2, l.namedBlocks["def"].paramCount)
 
+	items, l = runBlockLexer(`{{define card title, body = "(none)"}}456{{end card}}`)
+	assert.Len(t, items, 0)
+	assert.Equal(t, []blockParam{{name: "title"}, {name: "body", value: "(none)", hasDefault: true}}, l.namedBlocks["card"].params)
+	assert.Equal(t, 2, l.namedBlocks["card"].paramCount)
+
+	items, l = runBlockLexer(`{{define card title, title}}456{{end card}}`)
+	assert.Len(t, items, 1)
+	assert.Equal(t, itemError, items[0].typ)
+
+	items, l = runBlockLexer(`{{define card title, 2}}456{{end card}}`)
+	assert.Len(t, items, 1)
+	assert.Equal(t, itemError, items[0].typ)
+
 	items, l = runBlockLexer("{{< abc}}123")
 	assert.Len(t, items, 1)
 	assert.Equal(t, itemError, items[0].typ)
@@ -573,9 +630,9 @@ func Test_subsitute(t *testing.T) {
 
 	t.Run("error in block", func(t *testing.T) {
 		items, _ := runBlockLexer("{{< abc}}{{# {{end abc}}{{> abc}}")
-		assert.Equal(t, 2, len(items))
+		assert.Equal(t, 1, len(items))
 		assert.Equal(t, itemError, items[0].typ)
-		assert.Equal(t, itemError, items[1].typ)
+		assert.Equal(t, "abc", items[0].callStack[0].blockName)
 	})
 
 	t.Run("block in text", func(t *testing.T) {
@@ -596,6 +653,195 @@ func Test_subsitute(t *testing.T) {
 		assert.Equal(t, "123d", items[0].val)
 	})
 
+	t.Run("10 params", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< abc 10 }}$1-$10{{end abc}}{{> abc a,b,c,d,e,f,g,h,i,j}}")
+		assert.Equal(t, itemRun, items[0].typ)
+		assert.Equal(t, "a-j", items[0].val)
+	})
+
+	t.Run("spaces in params", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< a 2 }}[$1|$2]{{end a}}{{a Hello World, x y}}")
+		assert.Equal(t, itemRun, items[0].typ)
+		assert.Equal(t, "[HelloWorld|xy]", items[0].val)
+	})
+
+	t.Run("named params", func(t *testing.T) {
+		items, _ := runBlockLexer(`{{define card title, body="(none)"}}$title:$body:$titles:$1{{end card}}{{card "Hi"}}`)
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "Hi:(none):$titles:Hi", items[0].val)
+	})
+
+	t.Run("keyword params", func(t *testing.T) {
+		items, _ := runBlockLexer(`{{define card title, body="(none)"}}$title:$body{{end card}}{{card body="a, b", title="Hi"}}`)
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "Hi:a, b", items[0].val)
+
+		items, _ = runBlockLexer(`{{define card title, body="(none)"}}$title:$body{{end card}}{{> card Hi, body=There}}`)
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "Hi:There", items[0].val)
+	})
+
+	t.Run("quoted positional param", func(t *testing.T) {
+		items, _ := runBlockLexer(`{{define card title, body="(none)"}}$title:$body{{end card}}{{card "a=b"}}`)
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "a=b:(none)", items[0].val)
+
+		items, _ = runBlockLexer(`{{define card title, body="(none)"}}$title:$body{{end card}}{{card "x", "body=y"}}`)
+		assert.Equal(t, 1, len(items))
+		assert.Equal(t, "x:body=y", items[0].val)
+	})
+
+	t.Run("named param errors", func(t *testing.T) {
+		tests := []string{
+			`{{card}}`,                  // missing a required parameter
+			`{{card body="x"}}`,         // missing a required parameter
+			`{{card title=a, title=b}}`, // given twice
+			`{{card title=a, other=b}}`, // unknown name
+			`{{card title=a, b}}`,       // position after name
+			`{{card a, b, c}}`,          // too many
+			`{{card title="a}}`,         // bad quote
+		}
+		for _, tt := range tests {
+			items, _ := runBlockLexer(`{{define card title, body="(none)"}}$title:$body{{end card}}` + tt)
+			if assert.Equal(t, 1, len(items), tt) {
+				assert.Equal(t, itemError, items[0].typ, tt)
+			}
+		}
+
+		items, _ := runBlockLexer(`{{define card "title=a"}}$title{{end card}}`)
+		if assert.Equal(t, 1, len(items)) {
+			assert.Equal(t, itemError, items[0].typ)
+		}
+	})
+
+}
+
+func Test_tagBlockNames(t *testing.T) {
+	for _, name := range []string{"if", "default", "super", "plural", "msg", "call"} {
+		items, _ := runBlockLexer("{{< " + name + "}}a{{end " + name + "}}")
+		if assert.Equal(t, 1, len(items), name) {
+			assert.Equal(t, itemError, items[0].typ, name)
+			assert.Contains(t, items[0].val, "block name cannot be a tag name", name)
+		}
+	}
+	items, _ := runBlockLexer("{{< defaults}}a{{end defaults}}{{defaults}}")
+	if assert.Equal(t, 1, len(items)) {
+		assert.Equal(t, "a", items[0].val)
+	}
+}
+
+// Test_readmeTagNames checks that the README lists every tag name that a named block cannot have.
+func Test_readmeTagNames(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("..", "..", "README.md"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	readme := string(b)
+	_, list, found := strings.Cut(readme, "with one of these names is an error:\n")
+	if !assert.True(t, found) {
+		return
+	}
+	list, _, _ = strings.Cut(strings.TrimLeft(list, "\n"), "\n\n")
+	listed := make(map[string]bool)
+	for _, name := range strings.Fields(list) {
+		listed[name] = true
+	}
+
+	nameRegex := regexp.MustCompile(`^\{\{([A-Za-z_]\w*)(\}\})?$`)
+	for tok := range tokens {
+		if m := nameRegex.FindStringSubmatch(tok); m != nil {
+			assert.True(t, isTagName(m[1]), m[1])
+			assert.True(t, listed[m[1]], "README does not list tag name %s", m[1])
+		}
+	}
+	for name := range listed {
+		assert.True(t, isTagName(name), "README lists %s, which is not a tag name", name)
+	}
+}
+
+func Test_call(t *testing.T) {
+	t.Run("default slot", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< box}}[{{slot}}]{{end box}}{{call box}}abc{{call}}")
+		assert.Equal(t, 3, len(items))
+		assert.Equal(t, "[", items[0].val)
+		assert.Equal(t, "abc", items[1].val)
+		assert.Equal(t, "]", items[2].val)
+	})
+
+	t.Run("named slots", func(t *testing.T) {
+		items, _ := runBlockLexer(`{{define box title}}{{slot head}}$title{{slot}}{{slot foot}}{{end box}}{{call box title=T}}
+{{fill head}}H{{fill}}
+B
+{{fill foot -}}
+  F
+{{- fill}}
+{{- call}}`)
+		var vals []string
+		for _, item := range items {
+			vals = append(vals, item.val)
+		}
+		assert.Equal(t, []string{"H", "T", "\nB\n", "F"}, vals)
+	})
+
+	t.Run("nested calls", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< box}}[{{slot}}]{{end box}}{{call box}}a{{call box}}b{{call}}c{{call}}")
+		var vals []string
+		for _, item := range items {
+			vals = append(vals, item.val)
+		}
+		assert.Equal(t, []string{"[", "a", "[", "b", "]", "c", "]"}, vals)
+	})
+
+	t.Run("forwarded slot", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< box}}[{{slot}}]{{end box}}{{< page}}{{call box}}<{{slot}}>{{call}}{{end page}}{{call page}}a{{call}}")
+		var vals []string
+		for _, item := range items {
+			vals = append(vals, item.val)
+		}
+		assert.Equal(t, []string{"[", "<", "a", ">", "]"}, vals)
+	})
+
+	t.Run("empty slot", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< box}}[{{slot}}{{slot a}}]{{end box}}{{box}}")
+		assert.Equal(t, 2, len(items))
+		assert.Equal(t, "[", items[0].val)
+		assert.Equal(t, "]", items[1].val)
+	})
+
+	t.Run("location", func(t *testing.T) {
+		items, _ := runBlockLexer("{{< box}}\n[{{slot}}]{{end box}}{{call box}}\nab{{> nope}}{{call}}")
+		var found bool
+		for _, item := range items {
+			if item.typ == itemError {
+				found = true
+				// the error is located where the content was written, rather than in the block
+				assert.Equal(t, locationRef{blockName: "test", lineNum: 2, offset: 12}, item.callStack[0])
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []string{
+			"{{call box}}abc",                                            // no end
+			"{{call nope}}abc{{call}}",                                   // no block
+			"{{call box}}{{fill x}}a{{fill}}{{call}}",                    // no such slot
+			"{{call plain}}abc{{call}}",                                  // no default slot
+			"{{call box}}{{fill a}}a{{call}}",                            // fill not ended
+			"{{call box}}{{fill a}}a{{fill}}{{fill a}}b{{fill}}{{call}}", // duplicate fill
+			"{{call box}}a{{fill a}}b{{fill}}c{{call}}",                  // default content in two places
+			"{{call box}}a{{fill}}{{call}}",                              // stray end fill
+			"{{fill a}}b{{fill}}",                                        // fill outside of call
+		}
+		for _, tt := range tests {
+			items, _ := runBlockLexer("{{< box}}[{{slot}}{{slot a}}]{{end box}}{{< plain}}x{{end plain}}" + tt)
+			var found bool
+			for _, item := range items {
+				found = found || item.typ == itemError
+			}
+			assert.True(t, found, tt)
+		}
+	})
 }
 
 func Test_lexer_calcCurLineNum(t *testing.T) {
@@ -636,6 +882,50 @@ consider`)
 
 }
 
+func Test_Trim(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		types   []tokenType
+		vals    []string
+	}{
+		{"both sides", "a \n {{- = b -}} \n c", []tokenType{itemRun, itemString, itemRun, itemEnd, itemRun}, []string{"a", "", "b", "", "c"}},
+		{"before only", "a \n {{- = b}} c", []tokenType{itemRun, itemString, itemRun, itemEnd, itemRun}, []string{"a", "", "b", "", " c"}},
+		{"after only", "a {{= b -}} \n\t c", []tokenType{itemRun, itemString, itemRun, itemEnd, itemRun}, []string{"a ", "", "b", "", "c"}},
+		{"all white space", " \n {{- = b}}", []tokenType{itemString, itemRun, itemEnd}, []string{"", "b", ""}},
+		{"end block", "{{if a -}} \n b \n {{- if}} c", []tokenType{itemIf, itemRun, itemEnd, itemRun, itemEndBlock, itemRun}, []string{"", "a", "", "b", "if", " c"}},
+		{"end block trim after", "{{if a}}b{{else -}}\n c{{if}}", []tokenType{itemIf, itemRun, itemEnd, itemRun, itemEndBlock, itemRun, itemEndBlock}, []string{"", "a", "", "b", "else", "c", "if"}},
+		{"text", "{{- a -}}\n", []tokenType{itemText, itemRun, itemEnd}, []string{"", "a", ""}},
+		{"no space before dash", "{{= b-}}\n", []tokenType{itemString, itemRun, itemEnd, itemRun}, []string{"", "b-", "", "\n"}},
+		{"no space after dash", "a \n{{-x}}", []tokenType{itemRun, itemInterface, itemRun, itemEnd}, []string{"a \n", "", "-x", ""}},
+		{"negative value", "{{-x}} b", []tokenType{itemInterface, itemRun, itemEnd, itemRun}, []string{"", "-x", "", " b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, _ := runBlockLexer(tt.content)
+			var types []tokenType
+			var vals []string
+			for i, item := range items {
+				types = append(types, item.typ)
+				if tt.vals[i] != "" {
+					vals = append(vals, item.val)
+				} else {
+					vals = append(vals, "")
+				}
+			}
+			assert.Equal(t, tt.types, types)
+			assert.Equal(t, tt.vals, vals)
+		})
+	}
+
+	t.Run("named block", func(t *testing.T) {
+		items, _ := runBlockLexer("{{define a -}}\n b \n{{- end a}}[{{a}}]")
+		if assert.Len(t, items, 3) {
+			assert.Equal(t, "b", items[1].val)
+		}
+	})
+}
+
 func Test_Join(t *testing.T) {
 	t.Run("one line", func(t *testing.T) {
 		items, _ := runBlockLexer(`{{join a,b}}c{{join}}`)
@@ -1,92 +1,227 @@
 package got
 
 import (
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// defaultMaxErrors is the number of errors reported for a template before giving up, if not otherwise specified.
+const defaultMaxErrors = 10
+
 type parser struct {
+	c     *compilation
 	lexer *lexer
+
+	errors      []tokenItem // the errors found so far
+	stopped     bool        // true if too many errors were found to keep going
+	reportedEOF bool        // true if an unexpected end of file has been reported
+
+	// escapeByDefault is true if values are html escaped without the ! prefix. It starts out as set for the
+	// compilation, and is changed by escape tags, which apply to the rest of the template.
+	escapeByDefault bool
 }
 
 // parse is the main entry point for the recursive parsing process.
 //
 // parse should return either a single item that represents the top of the ast tree,
 // or an error item that contains the details of what and where the error happened.
+//
+// When an error is found, the parser records it and recovers at the next tag boundary, so that
+// as many errors as possible are found in one pass. If there is more than one error, the returned error item
+// lists them all in its childItems.
 func parse(l *lexer) tokenItem {
-	p := parser{lexer: l}
+	p := parser{c: l.c, lexer: l, escapeByDefault: l.c.escapeByDefault}
 	topItem := tokenItem{typ: itemGo}
-	var endItem tokenItem
-	topItem.childItems, endItem = p.parseRun()
-
-	extraItem := <-p.lexer.items
-	if extraItem.typ != itemEOF {
-		endItem.typ = itemError // Turn this into an error, we must have too many end tags
-	}
-	// if we have an error that has no call stack, extract all the errors from the channel and build a call stack from them
-	if endItem.typ == itemError {
-		if len(endItem.callStack) <= 1 {
-			for item := range p.lexer.items {
-				if item.typ == itemError {
-					endItem.callStack = append(endItem.callStack, item.callStack[0])
-				}
+	for {
+		items, endItem := p.parseRun()
+		topItem.childItems = append(topItem.childItems, items...)
+		if endItem.typ == itemEOF {
+			break
+		}
+		// we must have too many end tags
+		p.addError(endItem, unexpectedEndMessage(endItem))
+	}
+
+	switch len(p.errors) {
+	case 0:
+		return topItem
+	case 1:
+		return p.errors[0]
+	default:
+		return tokenItem{typ: itemError, val: p.errors[0].val, callStack: p.errors[0].callStack, childItems: p.errors}
+	}
+}
+
+// next returns the next item from the lexer. Errors found by the lexer are recorded here.
+// After an error, the lexer skips the rest of the tag it is in, so the caller should treat an error item
+// as the end of the current tag.
+func (p *parser) next() tokenItem {
+	if p.stopped {
+		return tokenItem{typ: itemEOF}
+	}
+	item := <-p.lexer.items
+	if item.typ == itemError {
+		p.recordError(item)
+	}
+	return item
+}
+
+// addError records an error at the location of the given item.
+func (p *parser) addError(at tokenItem, msg string) {
+	at.typ = itemError
+	at.val = msg
+	at.childItems = nil
+	at.params = nil
+	p.recordError(at)
+}
+
+// addEOFError records an unexpected end of file at the location of the tag that was not finished.
+// Only the first one is recorded, since every unfinished tag that encloses it would report it again.
+func (p *parser) addEOFError(at tokenItem) {
+	if !p.reportedEOF {
+		p.reportedEOF = true
+		p.addError(at, "unexpected end of file")
+	}
+}
+
+func (p *parser) recordError(e tokenItem) {
+	if p.stopped {
+		return
+	}
+	p.errors = append(p.errors, e)
+
+	max := p.c.maxErrors
+	if max == 0 {
+		max = defaultMaxErrors
+	}
+	if max > 0 && len(p.errors) >= max {
+		p.errors = append(p.errors, tokenItem{typ: itemError, val: "too many errors"})
+		p.stopped = true
+		// let the lexer finish
+		go func() {
+			for range p.lexer.items {
+			}
+		}()
+	}
+}
+
+// skipTag skips the rest of the current tag after an error. last is the most recent item read.
+func (p *parser) skipTag(last tokenItem) {
+	depth := 0
+	switch last.typ {
+	case itemEnd, itemError, itemEOF:
+		return // the tag is already finished
+	case itemRun, itemParam, itemEndBlock, itemStrictBlock:
+	default:
+		depth = 1 // last started a nested tag
+	}
+	for {
+		item := p.next()
+		switch item.typ {
+		case itemEOF:
+			return
+		case itemEnd:
+			if depth == 0 {
+				return
 			}
+			depth--
+		case itemRun, itemParam, itemEndBlock, itemStrictBlock, itemError:
+		default:
+			depth++
 		}
-		return endItem
 	}
-	return topItem
+}
+
+// tagError records an error at the location of the given item, skips the rest of the tag, and returns
+// the item as a failed parse.
+func (p *parser) tagError(at tokenItem, last tokenItem, msg string) (tokenItem, bool) {
+	p.addError(at, msg)
+	p.skipTag(last)
+	return at, false
+}
+
+func unexpectedEndMessage(endItem tokenItem) string {
+	if endItem.typ == itemEndBlock {
+		return "unexpected end block: {{" + endItem.val + "}}"
+	}
+	return "unexpected end tag"
 }
 
 // parseRun parses a run of text. This is typically text that is between an open and close tag.
+// Items that have errors are left out of the run.
 func (p *parser) parseRun() (subItems []tokenItem, endItem tokenItem) {
-	for item := range p.lexer.items {
-		item2 := p.parseRunItem(item)
-		switch item2.typ {
+	for {
+		item := p.next()
+		switch item.typ {
 		case itemEOF:
 			fallthrough
-		case itemError:
-			fallthrough
 		case itemEnd:
 			fallthrough
 		case itemEndBlock:
-			endItem = item2
+			endItem = item
 			return
+		case itemError:
+			continue // already recorded
+		}
+		if item2, ok := p.parseRunItem(item); ok {
+			subItems = append(subItems, item2)
+		}
+	}
+}
 
+// parseTagRun parses the run of items inside a tag that contains other tags, like a text or go tag,
+// up to the close tag. Stray end blocks are reported and skipped.
+func (p *parser) parseTagRun(openItem tokenItem) (subItems []tokenItem, ok bool) {
+	for {
+		items, endItem := p.parseRun()
+		subItems = append(subItems, items...)
+		switch endItem.typ {
+		case itemEnd:
+			return subItems, true
+		case itemEOF:
+			p.addEOFError(openItem)
+			return subItems, false
 		default:
-			subItems = append(subItems, item2)
+			p.addError(endItem, "unexpected tag at end of run")
 		}
 	}
-	endItem.typ = itemEOF
-	return
 }
 
-func (p *parser) parseRunItem(item tokenItem) tokenItem {
+// parseBody parses the items inside a block statement, like an if or for statement, up to the end block.
+// Stray end tags are reported and skipped.
+func (p *parser) parseBody(openItem tokenItem) (subItems []tokenItem, endItem tokenItem, ok bool) {
+	for {
+		var items []tokenItem
+		items, endItem = p.parseRun()
+		subItems = append(subItems, items...)
+		switch endItem.typ {
+		case itemEndBlock:
+			return subItems, endItem, true
+		case itemEOF:
+			p.addEOFError(openItem)
+			return subItems, endItem, false
+		default:
+			p.addError(endItem, unexpectedEndMessage(endItem))
+		}
+	}
+}
+
+// parseRunItem parses the given item, and any items that belong to it. It returns false if there was an
+// error, in which case the error has been recorded.
+func (p *parser) parseRunItem(item tokenItem) (tokenItem, bool) {
 	switch item.typ {
 
 	// These all do nothing, and eventually just return the item
-	case itemEOF:
-	case itemError:
 	case itemRun:
 	case itemStrictBlock:
-	case itemEnd:
-	case itemEndBlock:
 
 	case itemText:
 		fallthrough
 	case itemGo:
-		var endItem tokenItem
-		item.childItems, endItem = p.parseRun()
-		if endItem.typ != itemEnd {
-			if endItem.typ == itemEOF {
-				endItem.typ = itemError
-				endItem.val = "unexpected end of file"
-			}
-			if endItem.typ != itemError {
-				endItem.typ = itemError
-				endItem.val = "unexpected tag at end of run"
-			}
-			return endItem
-		}
-		return item
+		var ok bool
+		item.childItems, ok = p.parseTagRun(item)
+		return item, ok
 
 	case itemString:
 		fallthrough
@@ -109,280 +244,512 @@ func (p *parser) parseRunItem(item tokenItem) tokenItem {
 	case itemBytes:
 		fallthrough
 	case itemGoErr:
-		item2 := p.parseValue(item)
-		return item2
-
-	case itemIf:
-		ifItems := p.parseIf(item)
-		if len(ifItems) > 0 {
-			if ifItems[0].typ == itemError {
-				return ifItems[0]
+		item, ok := p.parseValue(item)
+		if ok && p.escapeByDefault && !item.raw {
+			switch item.typ {
+			case itemString, itemInterface, itemBytes, itemGoLiteral:
+				item.escaped = true
 			}
-			// push the if items down to the childItems of overriding if item
-			return tokenItem{typ: itemIf, childItems: ifItems}
 		}
+		return item, ok
+
+	case itemEscape:
+		return p.parseEscape(item)
+
+	case itemIf:
+		ifItems, ok := p.parseIf(item)
+		// push the if items down to the childItems of overriding if item
+		return tokenItem{typ: itemIf, childItems: ifItems}, ok
 
 	case itemJoin:
-		item2 := p.parseJoin(item)
-		return item2
+		return p.parseJoin(item)
+
+	case itemMessage:
+		item, ok := p.parseMessage(item)
+		if ok && p.escapeByDefault {
+			item.escaped = true
+		}
+		return item, ok
 
 	case itemFor:
-		item2 := p.parseFor(item)
-		return item2
+		return p.parseFor(item)
+
+	case itemSwitch:
+		return p.parseSwitch(item)
 
 	default:
 		panic("unexpected token") // this is a programming bug, not a template error
 	}
 
-	return item
+	return item, true
 }
 
-func (p *parser) parseValue(item tokenItem) tokenItem {
-	runItem := <-p.lexer.items
+func (p *parser) parseValue(item tokenItem) (tokenItem, bool) {
+	runItem := p.next()
 	switch runItem.typ {
 	case itemRun:
 		item.val = strings.TrimSpace(runItem.val)
 		if item.val == "" {
-			item.typ = itemError
-			item.val = "missing value"
-			return item
+			return p.tagError(item, runItem, "missing value")
 		}
 	case itemEnd:
-		item.typ = itemError
-		item.val = "missing value"
-		return item
+		return p.tagError(item, runItem, "missing value")
 	case itemEOF:
-		item.typ = itemError
-		item.val = "unexpected end of file"
-		return item
+		p.addEOFError(item)
+		return item, false
 	case itemError:
-		return runItem
+		return item, false
 	default:
-		runItem.typ = itemError
-		runItem.val = "unexpected text inside a value block"
-		return runItem
+		return p.tagError(runItem, runItem, "unexpected text inside a value block")
 	}
 
-	endItem := <-p.lexer.items
+	endItem := p.next()
 	switch endItem.typ {
 	case itemEnd:
-		return item // correctly terminated a value
+		return item, true // correctly terminated a value
 	case itemEOF:
-		endItem.typ = itemError
-		endItem.val = "unexpected end of file"
-		return endItem
+		p.addEOFError(item)
+		return item, false
 	case itemError:
-		return endItem
+		return item, false
 	default:
-		endItem.typ = itemError
-		endItem.val = "unexpected text inside a value block"
-		return endItem
+		return p.tagError(endItem, endItem, "unexpected text inside a value block")
 	}
 }
 
-func (p *parser) parseIf(item tokenItem) (items []tokenItem) {
-	if item.typ != itemElse {
-		conditionItem := <-p.lexer.items
-		switch conditionItem.typ {
-		case itemRun:
-			item.val = strings.TrimSpace(conditionItem.val)
-		case itemEnd:
-			conditionItem.typ = itemError
-			conditionItem.val = "missing condition in if statement"
-			return []tokenItem{conditionItem}
-		case itemEOF:
-			conditionItem.typ = itemError
-			conditionItem.val = "unexpected end of file"
-			return []tokenItem{conditionItem}
-		case itemError:
-			return []tokenItem{conditionItem}
-		default:
-			conditionItem.typ = itemError
-			conditionItem.val = "unexpected text inside a value definition"
-			return []tokenItem{conditionItem}
-		}
+// parseEscape reads an escape tag, which turns escaping values by default on or off for the rest of the template.
+func (p *parser) parseEscape(item tokenItem) (tokenItem, bool) {
+	item, ok := p.parseValue(item)
+	if !ok {
+		return item, false
+	}
+	switch item.val {
+	case "on":
+		p.escapeByDefault = true
+	case "off":
+		p.escapeByDefault = false
+	default:
+		p.addError(item, "escape must be followed by on or off")
+		return item, false
+	}
+	return item, true
+}
 
-		endItem := <-p.lexer.items
-		switch endItem.typ {
-		case itemEnd:
-			// correctly terminated a value, so keep going
-		case itemEOF:
-			endItem.typ = itemError
-			endItem.val = "unexpected end of file"
-			return []tokenItem{endItem}
-		case itemError:
-			return []tokenItem{endItem}
-		default:
-			endItem.typ = itemError
-			endItem.val = "unexpected text inside an if statement"
-			return []tokenItem{endItem}
+// parseCondition reads the condition of an if, elseif or for tag into item, up to the end of the tag.
+func (p *parser) parseCondition(item *tokenItem, statement string) bool {
+	conditionItem := p.next()
+	switch conditionItem.typ {
+	case itemRun:
+		item.val = strings.TrimSpace(conditionItem.val)
+		if item.val == "" {
+			p.tagError(conditionItem, conditionItem, "missing condition in "+statement+" statement")
+			return false
 		}
+	case itemEnd:
+		p.addError(conditionItem, "missing condition in "+statement+" statement")
+		return false
+	case itemEOF:
+		p.addEOFError(*item)
+		return false
+	case itemError:
+		return false
+	default:
+		p.tagError(conditionItem, conditionItem, "unexpected text inside a value definition")
+		return false
 	}
 
-	var endItem tokenItem
-
-	// get the items inside the if statement
-	item.childItems, endItem = p.parseRun()
-
+	endItem := p.next()
 	switch endItem.typ {
-	case itemEndBlock:
-		// correctly terminated a value, so keep going
+	case itemEnd:
+		return true // correctly terminated a value, so keep going
 	case itemEOF:
-		endItem.typ = itemError
-		endItem.val = "unexpected end of file"
-		return []tokenItem{endItem}
+		p.addEOFError(*item)
+		return false
 	case itemError:
-		return []tokenItem{endItem}
+		return false
 	default:
-		endItem.typ = itemError
-		endItem.val = "unexpected end of an if statement"
-		return []tokenItem{endItem}
+		p.tagError(endItem, endItem, "unexpected text inside "+statement+" statement")
+		return false
+	}
+}
+
+// parseIf parses an if, elseif or else tag and the items inside it. It also parses any elseif and else tags
+// that follow, and returns all the clauses in order.
+func (p *parser) parseIf(item tokenItem) (items []tokenItem, ok bool) {
+	ok = true
+	if item.typ != itemElse {
+		// even if the condition is bad, keep going so that the end of the statement is found
+		ok = p.parseCondition(&item, "if")
+	}
+
+	// get the items inside the if statement
+	var endItem tokenItem
+	var bodyOk bool
+	item.childItems, endItem, bodyOk = p.parseBody(item)
+	if !bodyOk {
+		return nil, false
 	}
 
 	switch endItem.val {
 	case "if":
 		// terminated the if statement
-		return []tokenItem{item}
+		return []tokenItem{item}, ok
 	case "else":
 		if item.typ == itemElse {
 			// cannot place an else after an else
-			endItem.typ = itemError
-			endItem.val = "cannot put an else after another else"
-			return []tokenItem{endItem}
+			p.addError(endItem, "cannot put an else after another else")
+			ok = false
 		}
 		elseItem := endItem
 		elseItem.typ = itemElse
-		items3 := p.parseIf(elseItem)
-		if len(items3) > 0 {
-			switch items3[0].typ {
-			case itemError:
-				return []tokenItem{items3[0]}
-			case itemEOF:
-				elseItem.typ = itemError
-				elseItem.val = "unexpected end of file"
-				return []tokenItem{elseItem}
-			}
-		}
+		items3, ok3 := p.parseIf(elseItem)
 		items = append(items, item)
 		items = append(items, items3...)
-		return
+		return items, ok && ok3
 
 	case "elseif":
 		if item.typ == itemElse {
 			// cannot place an else after an else
-			item.typ = itemError
-			item.val = "cannot put an elseif after an else"
-			return []tokenItem{item}
+			p.addError(endItem, "cannot put an elseif after an else")
+			ok = false
 		}
-		elseIfItem := item
+		elseIfItem := endItem
 		elseIfItem.typ = itemElseIf
-		items3 := p.parseIf(elseIfItem)
-		if len(items3) > 0 {
-			switch items3[0].typ {
-			case itemError:
-				return []tokenItem{items3[0]}
-			case itemEOF:
-				elseIfItem.typ = itemError
-				elseIfItem.val = "unexpected end of file"
-				return []tokenItem{elseIfItem}
-			}
-		}
+		items3, ok3 := p.parseIf(elseIfItem)
 		items = append(items, item)
 		items = append(items, items3...)
-		return
+		return items, ok && ok3
 
 	default:
-		item.typ = itemError
-		item.val = "unexpected end block item"
-		return []tokenItem{item}
+		// treat the wrong end block as the end of the if statement
+		p.addError(endItem, "unexpected end block item")
+		return []tokenItem{item}, false
 	}
 }
 
-func (p *parser) parseFor(item tokenItem) tokenItem {
-	conditionItem := <-p.lexer.items
-	switch conditionItem.typ {
-	case itemRun:
-		item.val = strings.TrimSpace(conditionItem.val)
-	case itemEnd:
-		conditionItem.typ = itemError
-		conditionItem.val = "missing condition in for statement"
-		return conditionItem
-	case itemEOF:
-		conditionItem.typ = itemError
-		conditionItem.val = "unexpected end of file"
-		return conditionItem
-	case itemError:
-		return conditionItem
-	default:
-		conditionItem.typ = itemError
-		conditionItem.val = "unexpected text inside a value definition"
-		return conditionItem
+func (p *parser) parseFor(item tokenItem) (tokenItem, bool) {
+	// even if the condition is bad, keep going so that the end of the statement is found
+	ok := p.parseCondition(&item, "for")
+
+	// get the items inside the for statement
+	var endItem tokenItem
+	var bodyOk bool
+	item.childItems, endItem, bodyOk = p.parseBody(item)
+	if !bodyOk {
+		return item, false
 	}
+	if endItem, bodyOk = p.parseEmpty(&item, endItem); !bodyOk {
+		return item, false
+	}
+	if endItem.val != "for" {
+		// treat the wrong end block as the end of the for statement
+		p.addError(endItem, "unexpected end block of for, got: "+endItem.val)
+		return item, false
+	}
+	return item, ok
+}
 
-	endItem := <-p.lexer.items
-	switch endItem.typ {
-	case itemEnd:
-		// correctly terminated a value, so keep going
-	case itemEOF:
-		endItem.typ = itemError
-		endItem.val = "unexpected end of file"
-		return endItem
-	case itemError:
-		return endItem
-	default:
-		endItem.typ = itemError
-		endItem.val = "unexpected text inside an if statement"
-		return endItem
+// parseEmpty parses the optional empty section of a for or join statement, if endItem starts one.
+// The section is put in the "empty" param of item. It returns the item that ends the statement.
+func (p *parser) parseEmpty(item *tokenItem, endItem tokenItem) (tokenItem, bool) {
+	if endItem.val != "empty" {
+		return endItem, true
+	}
+	emptyItem := endItem
+	emptyItem.typ = itemEmpty
+	emptyItem.val = ""
+	var ok bool
+	emptyItem.childItems, endItem, ok = p.parseBody(emptyItem)
+	if item.params == nil {
+		item.params = make(map[string]tokenItem)
+	}
+	item.params["empty"] = emptyItem
+	if ok && endItem.val == "empty" {
+		p.addError(endItem, "cannot put an empty after another empty")
+		return endItem, false
 	}
+	return endItem, ok
+}
 
-	// get the items inside the for statement
-	item.childItems, endItem = p.parseRun()
+// parseSwitch parses a switch tag, and the case and default tags inside it. The cases are returned
+// as the childItems of the switch item.
+func (p *parser) parseSwitch(item tokenItem) (tokenItem, bool) {
+	// even if the condition is bad, keep going so that the end of the statement is found
+	ok := p.parseCondition(&item, "switch")
 
-	switch endItem.typ {
-	case itemEndBlock:
-		// correctly terminated a value, so keep going
-		if endItem.val != "for" {
-			endItem.typ = itemError
-			endItem.val = "unexpected end block of for, got: " + endItem.val
-			return endItem
+	// only white space may come before the first case
+	items, endItem, bodyOk := p.parseBody(item)
+	if !bodyOk {
+		return item, false
+	}
+	if !p.onlyWhiteSpace(items) {
+		ok = false
+	}
+
+	var hasDefault bool
+	for {
+		var caseItem tokenItem
+		switch endItem.val {
+		case "switch":
+			// terminated the switch statement
+			return item, ok
+		case "case":
+			caseItem = endItem
+			caseItem.typ = itemCase
+			if !p.parseCondition(&caseItem, "case") {
+				ok = false
+			}
+		case "default":
+			if hasDefault {
+				p.addError(endItem, "cannot have more than one default in a switch statement")
+				ok = false
+			}
+			hasDefault = true
+			caseItem = endItem
+			caseItem.typ = itemDefault
+			caseItem.val = ""
+		default:
+			// treat the wrong end block as the end of the switch statement
+			p.addError(endItem, "unexpected end block of switch, got: "+endItem.val)
+			return item, false
+		}
+
+		caseItem.childItems, endItem, bodyOk = p.parseBody(caseItem)
+		item.childItems = append(item.childItems, caseItem)
+		if !bodyOk {
+			return item, false
 		}
-	case itemEOF:
-		endItem.typ = itemError
-		endItem.val = "unexpected end of file"
-		return endItem
-	case itemError:
-		return endItem
-	default:
-		endItem.typ = itemError
-		endItem.val = "unexpected end of a for statement"
-		return endItem
 	}
-	return item
 }
 
-func (p *parser) parseJoin(item tokenItem) tokenItem {
-	sliceItem := <-p.lexer.items
-	connectorItem := <-p.lexer.items
+// onlyWhiteSpace reports an error if items contains anything other than white space.
+func (p *parser) onlyWhiteSpace(items []tokenItem) bool {
+	for _, i := range items {
+		if i.typ != itemRun || strings.TrimSpace(i.val) != "" {
+			p.addError(i, "only case and default tags can be placed directly inside a switch statement")
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) parseJoin(item tokenItem) (tokenItem, bool) {
+	// even if the parameters are bad, keep going so that the end of the statement is found
+	ok := p.parseJoinParams(&item)
+
+	var endItem tokenItem
+	var bodyOk bool
+	item.childItems, endItem, bodyOk = p.parseBody(item)
+	if !bodyOk {
+		return item, false
+	}
+	if endItem, bodyOk = p.parseEmpty(&item, endItem); !bodyOk {
+		return item, false
+	}
+	if endItem.val != "join" {
+		p.addError(endItem, "expected ending join tag")
+		return item, false
+	}
+	return item, ok
+}
+
+// joinVarsRegex matches the last loop variable and the collection of a join statement, in either the
+// "value, key in collection" form or the "key, value := range collection" form.
+var joinVarsRegex = regexp.MustCompile(`^([A-Za-z_]\w*)(\s+in|\s*:=\s*range)\s+(.+)$`)
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_]\w*$`)
 
-	if sliceItem.typ != itemParam || connectorItem.typ != itemParam {
-		item.typ = itemError
-		item.val = "expected parameter of join statement"
-		return item
+// parseJoinParams reads the parameters of a join tag into item, up to the end of the tag.
+//
+// The parameters start with the loop variables and the collection to loop over, followed by the join string and then any options.
+// The loop variables can be given as "value in collection", "value, key in collection", or as a go range clause like
+// "key, value := range collection". If no loop variables are given, the key and value are _i and _j.
+func (p *parser) parseJoinParams(item *tokenItem) bool {
+	var params []tokenItem
+	for {
+		paramItem := p.next()
+		if paramItem.typ == itemParam {
+			params = append(params, paramItem)
+			continue
+		}
+		if paramItem.typ == itemEnd {
+			break
+		}
+		if paramItem.typ != itemError {
+			p.addError(*item, "expected parameter of join statement")
+			p.skipTag(paramItem)
+		}
+		return false
 	}
+
 	item.params = make(map[string]tokenItem)
-	item.params["slice"] = sliceItem
-	item.params["joinString"] = connectorItem
-	endItem := <-p.lexer.items
-	if endItem.typ != itemEnd {
-		endItem.typ = itemError
-		endItem.val = "expected end of join statement"
-		return endItem
-	}
-	item.childItems, endItem = p.parseRun()
-	if endItem.typ != itemEndBlock || endItem.val != "join" {
-		endItem.typ = itemError
-		endItem.val = "expected ending join tag"
-		return endItem
+	key := tokenItem{val: "_i"}
+	value := tokenItem{val: "_j"}
+	var rest []tokenItem
+
+	n := -1 // the index of the param with the collection, if there are loop variables
+	var m []string
+	for i, param := range params {
+		if m = joinVarsRegex.FindStringSubmatch(param.val); m != nil {
+			n = i
+			break
+		}
+		if !identifierRegex.MatchString(param.val) {
+			break
+		}
+	}
+	if n < 0 {
+		if len(params) > 0 {
+			item.params["slice"] = params[0]
+			rest = params[1:]
+		}
+		item.params["implicitVars"] = tokenItem{}
+	} else {
+		var names []string
+		for _, param := range params[:n] {
+			names = append(names, param.val)
+		}
+		names = append(names, m[1])
+		if len(names) > 2 {
+			p.addError(params[0], "too many loop variables in join statement")
+			return false
+		}
+		if strings.TrimSpace(m[2]) == "in" {
+			value.val = names[0]
+			key.val = "_"
+			if len(names) > 1 {
+				key.val = names[1]
+			}
+		} else {
+			key.val = names[0]
+			value.val = ""
+			if len(names) > 1 {
+				value.val = names[1]
+			}
+		}
+		collection := params[n]
+		collection.val = m[3]
+		item.params["slice"] = collection
+		rest = params[n+1:]
+	}
+	item.params["key"] = key
+	item.params["value"] = value
+
+	if len(rest) == 0 {
+		p.addError(*item, "expected parameter of join statement")
+		return false
+	}
+	item.params["joinString"] = rest[0]
+	for _, option := range rest[1:] {
+		switch option.val {
+		case "sorted":
+			item.params["sorted"] = option
+		default:
+			p.addError(option, "unknown join option: "+option.val)
+			return false
+		}
+	}
+	return true
+}
+
+// parseMessage parses a msg tag, and the text of the message up to the ending msg tag. The text is put in the "text" param
+// of the item, and the text after a plural tag in the "plural" param. The id, context and count parameters go in the params
+// of the same names, and the other parameters, which are the values to put in the text, go in childItems.
+func (p *parser) parseMessage(item tokenItem) (tokenItem, bool) {
+	// even if the parameters are bad, keep going so that the end of the message is found
+	ok := p.parseMessageParams(&item)
+
+	text, endItem, bodyOk := p.parseMessageText(item)
+	if !bodyOk {
+		return item, false
+	}
+	item.params["text"] = text
+	if endItem.val == "plural" {
+		var plural tokenItem
+		if plural, endItem, bodyOk = p.parseMessageText(endItem); !bodyOk {
+			return item, false
+		}
+		item.params["plural"] = plural
+		if _, ok2 := item.params["count"]; !ok2 {
+			p.addError(item, "a msg tag with a plural must have a count parameter")
+			ok = false
+		}
+	}
+	if endItem.val != "msg" {
+		p.addError(endItem, "expected ending msg tag")
+		return item, false
+	}
+	return item, ok
+}
+
+// parseMessageText parses the text of a message, up to the plural or ending msg tag. Only text may be in a message,
+// since it is the text that gets translated.
+func (p *parser) parseMessageText(openItem tokenItem) (text tokenItem, endItem tokenItem, ok bool) {
+	var items []tokenItem
+	items, endItem, ok = p.parseBody(openItem)
+	text = tokenItem{typ: itemRun, callStack: openItem.callStack}
+	for _, i := range items {
+		if i.typ != itemRun {
+			p.addError(i, "only text can be placed inside a msg tag")
+			ok = false
+			continue
+		}
+		text.val += i.val
+	}
+	return
+}
+
+var messageParamRegex = regexp.MustCompile(`^([A-Za-z_]\w*)\s*=\s*(.+)$`)
+
+// parseMessageParams reads the name=value parameters of a msg tag into item, up to the end of the tag.
+func (p *parser) parseMessageParams(item *tokenItem) bool {
+	item.params = make(map[string]tokenItem)
+	ok := true
+	names := make(map[string]bool)
+	for {
+		paramItem := p.next()
+		switch paramItem.typ {
+		case itemParam:
+		case itemEnd:
+			return ok
+		case itemError:
+			return false
+		default:
+			p.addError(*item, "expected parameter of msg tag")
+			p.skipTag(paramItem)
+			return false
+		}
+
+		m := messageParamRegex.FindStringSubmatch(paramItem.val)
+		if m == nil {
+			p.addError(paramItem, "expected a parameter of the form name=value in msg tag, got: "+paramItem.val)
+			ok = false
+			continue
+		}
+		name, value := m[1], m[2]
+		if names[name] {
+			p.addError(paramItem, "duplicate parameter in msg tag: "+name)
+			ok = false
+			continue
+		}
+		names[name] = true
+
+		switch name {
+		case "id", "context":
+			s, err := strconv.Unquote(value)
+			if err != nil {
+				p.addError(paramItem, "the "+name+" of a msg tag must be a quoted string")
+				ok = false
+				continue
+			}
+			paramItem.val = s
+			item.params[name] = paramItem
+		case "count":
+			paramItem.val = value
+			item.params[name] = paramItem
+		default:
+			paramItem.val = name + "=" + value
+			item.childItems = append(item.childItems, paramItem)
+		}
 	}
-	return item
 }
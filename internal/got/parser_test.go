@@ -1,13 +1,14 @@
 package got
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func parseContent(content string) tokenItem {
-	l := lexBlock("test", content, nil)
+	l := lexBlock(newCompilation(nil), "test", content, nil, nil, nil)
 	i := parse(l)
 	return i
 }
@@ -89,7 +90,8 @@ func Test_parse(t *testing.T) {
 	t.Run("join", func(t *testing.T) {
 		item := parseContent("{{join a.b, c}}d{{join}}")
 		assert.Equal(t, itemJoin, item.childItems[0].typ)
-		assert.Equal(t, 2, len(item.childItems[0].params))
+		assert.Equal(t, "_i", item.childItems[0].params["key"].val)
+		assert.Equal(t, "_j", item.childItems[0].params["value"].val)
 		assert.Equal(t, "a.b", item.childItems[0].params["slice"].val)
 		assert.Equal(t, "c", item.childItems[0].params["joinString"].val)
 		assert.Equal(t, 1, len(item.childItems[0].childItems))
@@ -100,7 +102,8 @@ func Test_parse(t *testing.T) {
 	t.Run("join2", func(t *testing.T) {
 		item := parseContent("{{join a.b, c}}{{i d}}{{join}}")
 		assert.Equal(t, itemJoin, item.childItems[0].typ)
-		assert.Equal(t, 2, len(item.childItems[0].params))
+		assert.Equal(t, "_i", item.childItems[0].params["key"].val)
+		assert.Equal(t, "_j", item.childItems[0].params["value"].val)
 		assert.Equal(t, "a.b", item.childItems[0].params["slice"].val)
 		assert.Equal(t, "c", item.childItems[0].params["joinString"].val)
 		assert.Equal(t, 1, len(item.childItems[0].childItems))
@@ -293,6 +296,136 @@ func Test_parseForErr(t *testing.T) {
 
 }
 
+func Test_parseJoinVars(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		key        string
+		value      string
+		collection string
+		sorted     bool
+	}{
+		{"value", `{{join item in a.b, ", "}}`, "_", "item", "a.b", false},
+		{"value and key", `{{join item, idx in a.b, ", "}}`, "idx", "item", "a.b", false},
+		{"range", `{{join v := range f(x), ", "}}`, "v", "", "f(x)", false},
+		{"range with key", `{{join k, v := range m, ", "}}`, "k", "v", "m", false},
+		{"sorted", `{{join v, k in m, ", ", sorted}}`, "k", "v", "m", true},
+		{"implicit", `{{join m, ", "}}`, "_i", "_j", "m", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := parseContent(tt.content + "a{{join}}")
+			if assert.Equal(t, itemGo, item.typ, item.val) {
+				params := item.childItems[0].params
+				assert.Equal(t, tt.key, params["key"].val)
+				assert.Equal(t, tt.value, params["value"].val)
+				assert.Equal(t, tt.collection, params["slice"].val)
+				assert.Equal(t, ", ", params["joinString"].val)
+				_, sorted := params["sorted"]
+				assert.Equal(t, tt.sorted, sorted)
+			}
+		})
+	}
+
+	t.Run("too many vars", func(t *testing.T) {
+		item := parseContent("{{join a, b, c in d, \",\"}}a{{join}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("unknown option", func(t *testing.T) {
+		item := parseContent("{{join a in d, \",\", backwards}}a{{join}}")
+		assert.Equal(t, "unknown join option: backwards", item.val)
+	})
+	t.Run("no join string", func(t *testing.T) {
+		item := parseContent("{{join a in d}}a{{join}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+}
+
+func Test_parseEmpty(t *testing.T) {
+	item := parseContent("{{for a}}b{{empty}}c{{for}}{{join a, \",\"}}b{{empty}}d{{join}}{{for a}}b{{for}}")
+	if assert.Equal(t, itemGo, item.typ) && assert.Len(t, item.childItems, 3) {
+		forItem := item.childItems[0]
+		assert.Equal(t, "b", forItem.childItems[0].val)
+		assert.Equal(t, itemEmpty, forItem.params["empty"].typ)
+		assert.Equal(t, "c", forItem.params["empty"].childItems[0].val)
+
+		joinItem := item.childItems[1]
+		assert.Equal(t, "a", joinItem.params["slice"].val)
+		assert.Equal(t, "d", joinItem.params["empty"].childItems[0].val)
+
+		_, ok := item.childItems[2].params["empty"]
+		assert.False(t, ok)
+	}
+
+	t.Run("two empties", func(t *testing.T) {
+		item := parseContent("{{for a}}b{{empty}}c{{empty}}d{{for}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("wrong end", func(t *testing.T) {
+		item := parseContent("{{for a}}b{{empty}}c{{join}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("no end", func(t *testing.T) {
+		item := parseContent("{{join a, b}}b{{empty}}c")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("outside of loop", func(t *testing.T) {
+		item := parseContent("{{if a}}b{{empty}}c{{if}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+}
+
+func Test_parseSwitch(t *testing.T) {
+	item := parseContent("{{switch a}} {{case 1}}b{{case 2, 3}}c{{default}}d{{switch}}")
+	if assert.Equal(t, itemGo, item.typ) {
+		sw := item.childItems[0]
+		assert.Equal(t, itemSwitch, sw.typ)
+		assert.Equal(t, "a", sw.val)
+		if assert.Len(t, sw.childItems, 3) {
+			assert.Equal(t, itemCase, sw.childItems[0].typ)
+			assert.Equal(t, "1", sw.childItems[0].val)
+			assert.Equal(t, "b", sw.childItems[0].childItems[0].val)
+			assert.Equal(t, itemCase, sw.childItems[1].typ)
+			assert.Equal(t, "2, 3", sw.childItems[1].val)
+			assert.Equal(t, itemDefault, sw.childItems[2].typ)
+			assert.Equal(t, "d", sw.childItems[2].childItems[0].val)
+		}
+	}
+}
+
+func Test_parseSwitchErr(t *testing.T) {
+	t.Run("missing condition", func(t *testing.T) {
+		item := parseContent("{{switch }}{{case 1}}a{{switch}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("missing case value", func(t *testing.T) {
+		item := parseContent("{{switch a}}{{case }}a{{switch}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("text before case", func(t *testing.T) {
+		item := parseContent("{{switch a}}b{{case 1}}a{{switch}}")
+		assert.Equal(t, itemError, item.typ)
+		assert.Equal(t, "only case and default tags can be placed directly inside a switch statement", item.val)
+	})
+	t.Run("two defaults", func(t *testing.T) {
+		item := parseContent("{{switch a}}{{default}}a{{default}}b{{switch}}")
+		assert.Equal(t, itemError, item.typ)
+		assert.Equal(t, "cannot have more than one default in a switch statement", item.val)
+	})
+	t.Run("bad end", func(t *testing.T) {
+		item := parseContent("{{switch a}}{{case 1}}a{{for}}")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("no end", func(t *testing.T) {
+		item := parseContent("{{switch a}}{{case 1}}a")
+		assert.Equal(t, itemError, item.typ)
+	})
+	t.Run("stray case", func(t *testing.T) {
+		item := parseContent("{{case 1}}a")
+		assert.Equal(t, itemError, item.typ)
+	})
+}
+
 func Test_parseJoinErr(t *testing.T) {
 	t.Run("bad params 1", func(t *testing.T) {
 		item := parseContent("{{join ")
@@ -313,3 +446,116 @@ func Test_parseJoinErr(t *testing.T) {
 	})
 
 }
+
+func Test_parseMultipleErrors(t *testing.T) {
+	t.Run("all errors", func(t *testing.T) {
+		item := parseContent("{{i }}\n{{if }}a{{if}}\n{{> nope}}\n{{for x}}{{= }}{{for}}\n{{ ok }}")
+		assert.Equal(t, itemError, item.typ)
+		if assert.Len(t, item.childItems, 4) {
+			assert.Equal(t, "missing value", item.childItems[0].val)
+			assert.Equal(t, "missing condition in if statement", item.childItems[1].val)
+			assert.Equal(t, "named block not found: nope", item.childItems[2].val)
+			assert.Equal(t, "missing value", item.childItems[3].val)
+			assert.Equal(t, 3, item.childItems[3].callStack[0].lineNum)
+		}
+		s := newTemplateError(item).Error()
+		assert.Equal(t, 4, strings.Count(s, "Block test:"))
+	})
+
+	t.Run("extra end tags", func(t *testing.T) {
+		item := parseContent("a}}b{{if}}{{i c}}{{i }}")
+		if assert.Len(t, item.childItems, 3) {
+			assert.Equal(t, "unexpected end tag", item.childItems[0].val)
+			assert.Equal(t, "unexpected end block: {{if}}", item.childItems[1].val)
+			assert.Equal(t, "missing value", item.childItems[2].val)
+		}
+	})
+
+	t.Run("unexpected end of file is reported once", func(t *testing.T) {
+		item := parseContent("{{for a}}{{if b}}{{ c")
+		assert.Equal(t, itemError, item.typ)
+		assert.Empty(t, item.childItems)
+		assert.Equal(t, "unexpected end of file", item.val)
+	})
+
+	t.Run("error limit", func(t *testing.T) {
+		c := newCompilation(nil)
+		c.maxErrors = 2
+		item := parse(lexBlock(c, "test", "{{i }}{{i }}{{i }}{{i }}", nil, nil, nil))
+		if assert.Len(t, item.childItems, 3) {
+			assert.Equal(t, "too many errors", item.childItems[2].val)
+		}
+
+		c = newCompilation(nil)
+		c.maxErrors = -1
+		item = parse(lexBlock(c, "test", strings.Repeat("{{i }}", 20), nil, nil, nil))
+		assert.Len(t, item.childItems, 20)
+
+		item = parseContent(strings.Repeat("{{i }}", 20))
+		assert.Len(t, item.childItems, defaultMaxErrors+1)
+	})
+}
+
+func Test_parseEscape(t *testing.T) {
+	item := parseContent("{{= a}}{{escape on}}{{= a}}{{v a}}{{i a}}{{raw a}}{{escape off}}{{= a}}")
+	assert.Equal(t, itemGo, item.typ)
+	var escaped []bool
+	for _, i := range item.childItems {
+		if i.typ != itemEscape {
+			escaped = append(escaped, i.escaped)
+		}
+	}
+	assert.Equal(t, []bool{false, true, true, false, false, false}, escaped)
+
+	c := newCompilation(nil)
+	c.escapeByDefault = true
+	item = parse(lexBlock(c, "test", "{{= a}}{{raw a}}", nil, nil, nil))
+	assert.True(t, item.childItems[0].escaped)
+	assert.False(t, item.childItems[1].escaped)
+	assert.True(t, item.childItems[1].raw)
+
+	t.Run("bad value", func(t *testing.T) {
+		item := parseContent("{{escape html}}")
+		assert.Equal(t, itemError, item.typ)
+		assert.Equal(t, "escape must be followed by on or off", item.val)
+	})
+	t.Run("missing value", func(t *testing.T) {
+		item := parseContent("{{escape }}")
+		assert.Equal(t, itemError, item.typ)
+	})
+}
+
+func Test_parseMessage(t *testing.T) {
+	item := parseContent(`{{msg id="x", context="c", count=n, name=f(a, b)}}{count} {name}{{plural}}many{{msg}}`)
+	assert.Equal(t, itemGo, item.typ)
+	m := item.childItems[0]
+	assert.Equal(t, itemMessage, m.typ)
+	assert.Equal(t, "x", m.params["id"].val)
+	assert.Equal(t, "c", m.params["context"].val)
+	assert.Equal(t, "n", m.params["count"].val)
+	assert.Equal(t, "{count} {name}", m.params["text"].val)
+	assert.Equal(t, "many", m.params["plural"].val)
+	if assert.Len(t, m.childItems, 1) {
+		assert.Equal(t, "name=f(a, b)", m.childItems[0].val)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"not name=value", `{{msg a}}x{{msg}}`, "expected a parameter of the form name=value in msg tag, got: a"},
+		{"duplicate", `{{msg a=1, a=2}}x{{msg}}`, "duplicate parameter in msg tag: a"},
+		{"id not quoted", `{{msg id=x}}x{{msg}}`, "the id of a msg tag must be a quoted string"},
+		{"plural without count", `{{msg a=1}}x{{plural}}y{{msg}}`, "a msg tag with a plural must have a count parameter"},
+		{"not text", `{{msg a=1}}x{{= a}}{{msg}}`, "only text can be placed inside a msg tag"},
+		{"wrong end", `{{msg a=1}}x{{if}}`, "expected ending msg tag"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := parseContent(tt.content)
+			assert.Equal(t, itemError, item.typ)
+			assert.Equal(t, tt.wantErr, item.val)
+		})
+	}
+}
@@ -1,13 +1,19 @@
 package got
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/goradd/gofile/pkg/sys"
 )
@@ -30,19 +36,75 @@ const (
 	blockIncludeParent = "includeParent"
 )
 
+// dependencyPrefix starts each line in the header of a generated file that names a file the output depends on.
+const dependencyPrefix = "//got:dependency "
+
 type namedBlockEntry struct {
 	text       string
-	paramCount int
+	paramCount int          // the most parameters the block can be given
+	params     []blockParam // the named parameters of the block, if it was defined with names
 	ref        locationRef
 }
 
-var modules map[string]string
-var includePaths []string
-var includeNamedBlocks = make(map[string]namedBlockEntry)
+// blockParam is a named parameter of a named block.
+type blockParam struct {
+	name       string
+	value      string // the default value, used when the parameter is not given
+	hasDefault bool
+}
 
 // OutWriter helps us intercept output for testing
 var OutWriter io.Writer = os.Stdout
 
+// ErrWriter is where errors are reported, like the errors that Watch finds in templates. It helps us intercept them for testing.
+var ErrWriter io.Writer = os.Stderr
+
+// outWriterMutex serializes writes to OutWriter and ErrWriter when files are processed concurrently.
+var outWriterMutex sync.Mutex
+
+// Options are the options used by RunWithOptions. They mirror the command line flags of the got command.
+type Options struct {
+	// OutDir is the directory to write the output files to. If empty, output files are written next to their templates.
+	OutDir string
+	// Type is the file suffix of the templates to process from InputDirectory.
+	Type string
+	// RunImports runs goimports on each output file.
+	RunImports bool
+	// Includes is the list of include directories and prepended files, separated by ":" or ";".
+	Includes string
+	// InputDirectory is the directory to search for templates when Type is set.
+	InputDirectory string
+	// Files are the templates to process when Type is not set.
+	Files []string
+	// Verbose prints the name of each file as it is processed.
+	Verbose bool
+	// Recursive searches the subdirectories of InputDirectory too.
+	Recursive bool
+	// Force processes templates even if their output files are newer than the templates.
+	Force bool
+	// Jobs is the number of templates to compile at the same time. Values less than 1 are treated as 1.
+	Jobs int
+	// LineDirectives adds line directives to the generated code, so that compiler errors and panics refer to the templates.
+	LineDirectives bool
+	// MaxErrors is the number of errors to report for each template before giving up. Zero means the default of 10,
+	// and a negative number means there is no limit.
+	MaxErrors int
+	// MaxExpansionDepth is how deeply named blocks and include files may be nested inside each other.
+	// Zero means the default of 100, and a negative number means there is no limit.
+	MaxExpansionDepth int
+	// AutoEscape escapes every value to suit where it lands in the surrounding HTML. See CompileOptions.AutoEscape.
+	AutoEscape bool
+	// EscapeSuffixes lists file name endings, like ".html.got". Templates with names that end in one of them html escape
+	// values by default, as if they started with an {{escape on}} tag.
+	EscapeSuffixes []string
+	// Translator is the Go expression for the translator of msg tags. See CompileOptions.Translator.
+	Translator string
+	// TextTranslator is the Go expression for the translator of translate tags. See CompileOptions.TextTranslator.
+	TextTranslator string
+	// JSONDiagnostics makes Watch report errors as JSON, one diagnostic per line, like WriteJSONDiagnostics.
+	JSONDiagnostics bool
+}
+
 // Run processes the given GoT files with the given options.
 // It writes to the output files while processing, and returns an error if found.
 func Run(outDir string,
@@ -55,126 +117,273 @@ func Run(outDir string,
 	recursive bool,
 	force bool) (err error) {
 
-	if modules, err = sys.ModulePaths(); err != nil {
+	return RunWithOptions(Options{
+		OutDir:         outDir,
+		Type:           typ,
+		RunImports:     runImports,
+		Includes:       includes,
+		InputDirectory: inputDirectory,
+		Files:          files,
+		Verbose:        verbose,
+		Recursive:      recursive,
+		Force:          force,
+	})
+}
+
+// RunWithOptions processes GoT files as described by opts.
+// It writes to the output files while processing.
+//
+// If opts.Jobs is more than one, that many files are processed at the same time.
+// Every file is processed even if an earlier one fails, and the errors are
+// returned together in the order that the files were gathered.
+func RunWithOptions(opts Options) (err error) {
+	var r *runner
+	if r, err = newRunner(opts); err != nil {
 		return err
 	}
 
-	if inputDirectory != "" {
-		inputDirectory = getRealPath(inputDirectory)
-		if inputDirectory[len(inputDirectory)-1] != filepath.Separator {
-			inputDirectory += string(filepath.Separator)
+	var files []string
+	if files, err = r.gatherFiles(opts.Force); err != nil {
+		return err
+	}
+	return errors.Join(r.processFiles(files)...)
+}
+
+// runner holds the state shared by all the templates processed by one run of GoT.
+type runner struct {
+	opts    Options
+	modules map[string]string
+	cwd     string
+
+	// catalogs are the messages to translate found in each template, when extracting them rather than writing output files.
+	// Templates processed at the same time add to it, so access is guarded by catalogMutex.
+	catalogs     map[string]*catalog
+	catalogMutex sync.Mutex
+}
+
+// newRunner checks opts and resolves the directories in it.
+func newRunner(opts Options) (r *runner, err error) {
+	r = &runner{opts: opts}
+	if r.modules, err = sys.ModulePaths(); err != nil {
+		return nil, err
+	}
+
+	if r.opts.InputDirectory != "" {
+		r.opts.InputDirectory = realPath(r.opts.InputDirectory, r.modules)
+		if r.opts.InputDirectory[len(r.opts.InputDirectory)-1] != filepath.Separator {
+			r.opts.InputDirectory += string(filepath.Separator)
 		}
 	}
 
-	if recursive && typ == "" {
-		return fmt.Errorf("-t is required when specifying -r")
+	if r.opts.OutDir != "" {
+		// resolve now so that the output files can be found when checking whether they are out of date
+		r.opts.OutDir = realPath(r.opts.OutDir, r.modules)
 	}
 
-	if recursive && outDir != "" {
-		return fmt.Errorf("cannot specify an output directory when using the recursive option")
+	if r.opts.Recursive && r.opts.Type == "" {
+		return nil, fmt.Errorf("-t is required when specifying -r")
 	}
 
-	files, err = gatherFiles(files,
-		inputDirectory,
-		outDir,
-		typ,
-		recursive,
-		force,
-	)
-	if err != nil {
-		return err
+	if r.opts.Recursive && r.opts.OutDir != "" {
+		return nil, fmt.Errorf("cannot specify an output directory when using the recursive option")
 	}
 
-	var cwd string
-	cwd, err = os.Getwd()
+	r.cwd, err = os.Getwd()
 	if err != nil {
-		return fmt.Errorf("could not get the current directory: %s", err.Error())
+		return nil, fmt.Errorf("could not get the current directory: %s", err.Error())
 	}
-	for _, file := range files {
-		f := file
-		if verbose {
-			fmt.Fprintf(OutWriter, "Processing %s\n", f)
-		}
-		f = filepath.FromSlash(f)
-		dir, _ := filepath.Split(f)
-		if dir != "" {
-			dir, _ = filepath.Abs(dir)
-		}
+	return r, nil
+}
 
-		var includeFiles []string
-		includeFiles, includePaths, err = processIncludeString(includes)
-		if err != nil {
-			return err
-		}
+// gatherFiles returns the templates to process. Unless force is true, only templates with out-of-date
+// output files are returned.
+func (r *runner) gatherFiles(force bool) ([]string, error) {
+	return gatherFiles(r.opts.Files,
+		r.opts.InputDirectory,
+		r.opts.OutDir,
+		r.opts.Type,
+		r.opts.Recursive,
+		force,
+	)
+}
 
-		if inputDirectory == "" || dir == "" {
-			includePaths = append(includePaths, cwd)
-		} else {
-			includePaths = append(includePaths, dir)
-		}
+// processFiles processes the given templates, using as many goroutines as requested by the Jobs option.
+// It returns the error from each template, in the same order as files.
+func (r *runner) processFiles(files []string) []error {
+	jobs := r.opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > len(files) {
+		jobs = len(files)
+	}
 
-		outDir2 := outDir
-		if outDir2 == "" {
-			outDir2 = dir
-			if outDir2 == "" {
-				outDir2 = cwd
+	errs := make([]error, len(files))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				errs[n] = r.processTemplate(files[n])
 			}
-		}
-		outDir2 = getRealPath(outDir2)
+		}()
+	}
+	for n := range files {
+		work <- n
+	}
+	close(work)
+	wg.Wait()
 
-		dstInfo, err2 := os.Stat(outDir2)
-		if err2 != nil {
-			return fmt.Errorf("the output directory %s does not exist. Create the output directory and run it again", outDir2)
-		}
-		if !dstInfo.Mode().IsDir() {
-			return fmt.Errorf("the output directory specified is not a directory")
-		}
+	return errs
+}
 
-		asts, err3 := prepIncludeFiles(includeFiles)
-		if err3 != nil {
-			return err3
+// processTemplate compiles one template file and writes its output file.
+func (r *runner) processTemplate(f string) (err error) {
+	opts := r.opts
+	if opts.Verbose {
+		outWriterMutex.Lock()
+		_, _ = fmt.Fprintf(OutWriter, "Processing %s\n", f)
+		outWriterMutex.Unlock()
+	}
+	f = filepath.FromSlash(f)
+	dir, _ := filepath.Split(f)
+	if dir != "" {
+		dir, _ = filepath.Abs(dir)
+	}
+
+	c := newCompilation(r.modules)
+	c.lineDirectives = opts.LineDirectives
+	c.maxErrors = opts.MaxErrors
+	c.maxExpansionDepth = opts.MaxExpansionDepth
+	c.autoEscape = opts.AutoEscape
+	c.translator = opts.Translator
+	c.textTranslator = opts.TextTranslator
+	if r.catalogs != nil {
+		c.catalog = new(catalog)
+		defer func() {
+			r.catalogMutex.Lock()
+			r.catalogs[f] = c.catalog
+			r.catalogMutex.Unlock()
+		}()
+	}
+	for _, suffix := range opts.EscapeSuffixes {
+		if suffix != "" && strings.HasSuffix(f, suffix) {
+			c.escapeByDefault = true
 		}
+	}
+	var includeFiles []string
+	includeFiles, c.includePaths, err = c.processIncludeString(opts.Includes)
+	if err != nil {
+		return err
+	}
 
-		err = processFile(f, outDir2, asts, runImports)
+	if opts.InputDirectory == "" || dir == "" {
+		c.includePaths = append(c.includePaths, r.cwd)
+	} else {
+		c.includePaths = append(c.includePaths, dir)
+	}
 
-		if err != nil {
-			return err
+	outDir := opts.OutDir
+	if outDir == "" {
+		outDir = dir
+		if outDir == "" {
+			outDir = r.cwd
 		}
 	}
-	return
+	outDir = c.realPath(outDir)
+
+	dstInfo, err2 := os.Stat(outDir)
+	if err2 != nil {
+		return fmt.Errorf("the output directory %s does not exist. Create the output directory and run it again", outDir)
+	}
+	if !dstInfo.Mode().IsDir() {
+		return fmt.Errorf("the output directory specified is not a directory")
+	}
+
+	asts, err3 := c.prepIncludeFiles(includeFiles)
+	if err3 != nil {
+		return err3
+	}
+
+	return c.processFile(f, outDir, asts, opts.RunImports)
 }
 
-func processFile(file, outDir string, asts []astType, runImports bool) error {
+func (c *compilation) processFile(file, outDir string, asts []astType, runImports bool) error {
 	newPath := outfilePath(file, outDir)
+	newPath, _ = filepath.Abs(newPath)
+	file, _ = filepath.Abs(file)
+	c.lineDirectiveDir = filepath.Dir(newPath)
+
+	a, err := c.buildAst(file, c.templateNamedBlocks(file, newPath))
+	if err != nil {
+		return err
+	}
+
+	var asts2 []astType
+	asts2 = append(asts2, asts...)
+	asts2 = append(asts2, a)
+
+	if c.catalog != nil {
+		// only the messages are needed
+		return c.writeAsts(io.Discard, "", asts2...)
+	}
+
+	changed, err := c.outputAsts(newPath, runImports, asts2...)
+	if err == nil && !changed && outputIsStale(file, newPath) {
+		// The code has not changed, so the file was left alone. Mark it as up to date with the files it came from,
+		// so that it is not processed again next time.
+		now := time.Now()
+		err = os.Chtimes(newPath, now, now)
+	}
+	return err
+}
+
+// templateNamedBlocks returns the named blocks that a template starts with. These are the
+// blocks defined in the include files, plus the predefined blocks that describe the template and
+// output file. Either path may be empty, in which case the matching predefined blocks are blank.
+func (c *compilation) templateNamedBlocks(file, outPath string) map[string]namedBlockEntry {
 	// duplicate the named blocks from the include files before passing them to individual files
 	namedBlocks := make(map[string]namedBlockEntry)
-	for k, v := range includeNamedBlocks {
+	for k, v := range c.includeNamedBlocks {
 		namedBlocks[k] = v
 	}
 
 	// Default named block values
-	namedBlocks[blockIncludePath] = namedBlockEntry{"", 0, locationRef{}}
-	namedBlocks[blockIncludeName] = namedBlockEntry{"", 0, locationRef{}}
-	namedBlocks[blockIncludeRoot] = namedBlockEntry{"", 0, locationRef{}}
-	namedBlocks[blockIncludeParent] = namedBlockEntry{"", 0, locationRef{}}
-
-	file, _ = filepath.Abs(file)
-	root := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
-	for {
-		ext := filepath.Ext(root)
-		if ext == "" {
-			break
-		}
-		root = strings.TrimSuffix(root, ext)
+	namedBlocks[blockIncludePath] = namedBlockEntry{text: ""}
+	namedBlocks[blockIncludeName] = namedBlockEntry{text: ""}
+	namedBlocks[blockIncludeRoot] = namedBlockEntry{text: ""}
+	namedBlocks[blockIncludeParent] = namedBlockEntry{text: ""}
+
+	var name, root, parent string
+	if file != "" {
+		name = filepath.Base(file)
+		root = fileRoot(file)
+		parent = filepath.Base(filepath.Dir(file))
 	}
+	namedBlocks[blockTemplatePath] = namedBlockEntry{text: file}
+	namedBlocks[blockTemplateName] = namedBlockEntry{text: name}
+	namedBlocks[blockTemplateRoot] = namedBlockEntry{text: root}
+	namedBlocks[blockTemplateParent] = namedBlockEntry{text: parent}
+
+	name, root, parent = "", "", ""
+	if outPath != "" {
+		name = filepath.Base(outPath)
+		root = fileRoot(outPath)
+		parent = filepath.Base(filepath.Dir(outPath))
+	}
+	namedBlocks[blockOutPath] = namedBlockEntry{text: outPath}
+	namedBlocks[blockOutName] = namedBlockEntry{text: name}
+	namedBlocks[blockOutRoot] = namedBlockEntry{text: root}
+	namedBlocks[blockOutParent] = namedBlockEntry{text: parent}
 
-	namedBlocks[blockTemplatePath] = namedBlockEntry{file, 0, locationRef{}}
-	namedBlocks[blockTemplateName] = namedBlockEntry{filepath.Base(file), 0, locationRef{}}
-	namedBlocks[blockTemplateRoot] = namedBlockEntry{root, 0, locationRef{}}
-	namedBlocks[blockTemplateParent] = namedBlockEntry{filepath.Base(filepath.Dir(file)), 0, locationRef{}}
+	return namedBlocks
+}
 
-	newPath, _ = filepath.Abs(newPath)
-	root = strings.TrimSuffix(filepath.Base(newPath), filepath.Ext(newPath))
+// fileRoot returns the base name of the file with all of its extensions removed.
+func fileRoot(file string) string {
+	root := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
 	for {
 		ext := filepath.Ext(root)
 		if ext == "" {
@@ -182,29 +391,10 @@ func processFile(file, outDir string, asts []astType, runImports bool) error {
 		}
 		root = strings.TrimSuffix(root, ext)
 	}
-
-	namedBlocks[blockOutPath] = namedBlockEntry{newPath, 0, locationRef{}}
-	namedBlocks[blockOutName] = namedBlockEntry{filepath.Base(newPath), 0, locationRef{}}
-	namedBlocks[blockOutRoot] = namedBlockEntry{root, 0, locationRef{}}
-	namedBlocks[blockOutParent] = namedBlockEntry{filepath.Base(filepath.Dir(newPath)), 0, locationRef{}}
-
-	a, err := buildAst(file, namedBlocks)
-	if err != nil {
-		return err
-	}
-
-	var asts2 []astType
-	asts2 = append(asts2, asts...)
-	asts2 = append(asts2, a)
-
-	err = outputAsts(newPath, asts2...)
-	if err != nil {
-		return err
-	}
-	return postProcess(newPath, runImports)
+	return root
 }
 
-func processIncludeString(includes string) (includeFiles []string, includePaths []string, err error) {
+func (c *compilation) processIncludeString(includes string) (includeFiles []string, includePaths []string, err error) {
 	for includes != "" {
 		var cur string
 		if offset := strings.IndexAny(includes, ":;"); offset != -1 {
@@ -214,7 +404,7 @@ func processIncludeString(includes string) (includeFiles []string, includePaths
 			cur = includes
 			includes = ""
 		}
-		p := getRealPath(cur)
+		p := c.realPath(cur)
 		if fi, err2 := os.Stat(p); err2 != nil {
 			err = fmt.Errorf("include path %s: %s", p, err2.Error())
 			return
@@ -227,10 +417,11 @@ func processIncludeString(includes string) (includeFiles []string, includePaths
 	return
 }
 
-func prepIncludeFiles(includeFiles []string) (asts []astType, err error) {
+func (c *compilation) prepIncludeFiles(includeFiles []string) (asts []astType, err error) {
 	for _, f := range includeFiles {
 		var a astType
-		a, err = buildAst(f, includeNamedBlocks)
+		c.addDependency(f)
+		a, err = c.buildAst(f, c.includeNamedBlocks)
 		if err == nil {
 			asts = append(asts, a)
 		} else {
@@ -240,7 +431,8 @@ func prepIncludeFiles(includeFiles []string) (asts []astType, err error) {
 	return
 }
 
-func getRealPath(path string) string {
+// realPath converts a path that may start with a module name to a file system path.
+func realPath(path string, modules map[string]string) string {
 	newPath, err := sys.GetModulePath(path, modules)
 	if err != nil {
 		log.Fatal(err)
@@ -270,19 +462,64 @@ func outfilePath(file string, outDir string) string {
 	return file
 }
 
-func postProcess(file string, runImports bool) (err error) {
+// writeOutput writes src to the file at path, after running goimports on it if runImports is true, unless the file
+// already holds the same code. The code is written to a temporary file in the same directory first, which is then
+// renamed over the file, so that the file is never left partly written. A new file gets the permissions that
+// os.WriteFile would give it, and an existing file keeps its permissions. changed is true if the file was written.
+func writeOutput(path string, src []byte, runImports bool) (changed bool, err error) {
+	var f *os.File
+	var tmp string
+	for i := 0; ; i++ {
+		// The go tool ignores files that start with a dot. The file is opened the way os.WriteFile opens a file,
+		// so that the umask applies to it.
+		tmp = filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d-%d.tmp.go", filepath.Base(path), os.Getpid(), i))
+		f, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if !changed {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	_, err = f.Write(src)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return false, err
+	}
+
 	if runImports {
-		_, err = sys.ExecuteShellCommand("goimports -w " + file)
-		if err != nil {
-			if e, ok := err.(*exec.Error); ok {
-				return fmt.Errorf("error running goimports on file %s: %s", file, e.Error())
-			} else if err2, ok2 := err.(*exec.ExitError); ok2 {
+		if _, err = sys.ExecuteShellCommand("goimports -w " + tmp); err != nil {
+			if e, ok := err.(*exec.ExitError); ok {
 				// Likely a syntax error in the resulting file
-				return fmt.Errorf("%s", err2.Stderr)
+				return false, fmt.Errorf("%s", e.Stderr)
 			}
+			return false, fmt.Errorf("error running goimports on file %s: %s", path, err.Error())
+		}
+		if src, err = os.ReadFile(tmp); err != nil {
+			return false, err
+		}
+	}
+
+	if old, err2 := os.ReadFile(path); err2 == nil && bytes.Equal(old, src) {
+		return false, nil
+	}
+	if info, err2 := os.Stat(path); err2 == nil {
+		if err = os.Chmod(tmp, info.Mode().Perm()); err != nil {
+			return false, err
 		}
 	}
-	return nil
+	if err = os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Make a list of all the files that will be processed.
@@ -331,7 +568,7 @@ func gatherFiles(inFiles []string, inputDir string, outputDir string, suffix str
 
 	for _, f := range inFiles {
 		o := outfilePath(f, outputDir)
-		if fileIsNewer(f, o) {
+		if outputIsStale(f, o) {
 			files = append(files, f)
 		}
 	}
@@ -357,6 +594,49 @@ func getRecursiveDirectories(dirPath string) (dirs []string, err error) {
 	return
 }
 
+// outputIsStale returns true if the output file needs to be generated again from the template. That is the
+// case if the template, or any of the include files listed in the output file's header, is newer than the output file.
+// A missing dependency also makes the output stale, so that processing the template will report the problem.
+func outputIsStale(template, output string) bool {
+	if fileIsNewer(template, output) {
+		return true
+	}
+	for _, dep := range readDependencies(output) {
+		if _, err := os.Stat(dep); err != nil || fileIsNewer(dep, output) {
+			return true
+		}
+	}
+	return false
+}
+
+// readDependencies returns the paths of the files listed as dependencies in the header of a generated file.
+func readDependencies(output string) (deps []string) {
+	f, err := os.Open(output)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	dir := filepath.Dir(output)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "//") {
+			break // dependencies are only in the header comment
+		}
+		if dep, ok := strings.CutPrefix(line, dependencyPrefix); ok {
+			dep = filepath.FromSlash(dep)
+			if !filepath.IsAbs(dep) {
+				dep = filepath.Join(dir, dep)
+			}
+			deps = append(deps, dep)
+		}
+	}
+	return
+}
+
 // fileIsNewer returns true if the file at path1 is newer than the file at path2. If
 // there is no file at path2, returns true
 // If there is no file at path1, return false
@@ -1,8 +1,12 @@
 package got
 
 import (
-	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_getRecursiveDirectories(t *testing.T) {
@@ -24,3 +28,35 @@ func Test_fileIsNewer(t *testing.T) {
 	assert.False(t, r)
 
 }
+
+func Test_writeOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.go")
+
+	changed, err := writeOutput(path, []byte("package a\n"), false)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+
+	// the same code leaves the file alone
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(path, old, old))
+	changed, err = writeOutput(path, []byte("package a\n"), false)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	info, _ := os.Stat(path)
+	assert.True(t, info.ModTime().Equal(old))
+
+	// new code replaces the file, keeping its permissions
+	assert.NoError(t, os.Chmod(path, 0600))
+	changed, err = writeOutput(path, []byte("package b\n"), false)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	src, _ := os.ReadFile(path)
+	assert.Equal(t, "package b\n", string(src))
+	info, _ = os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// no temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1)
+}
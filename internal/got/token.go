@@ -1,7 +1,5 @@
 package got
 
-import "fmt"
-
 // Sets up the token map, mapping tokens to items. Allows us to use a variety of different tokens for the
 // same tokenItem, including translations
 
@@ -17,6 +15,7 @@ type locationRef struct {
 type tokenItem struct {
 	typ        tokenType
 	escaped    bool
+	raw        bool // output as is, even when values are escaped by default
 	optional   bool
 	withError  bool
 	translate  bool
@@ -30,6 +29,10 @@ type tokenItem struct {
 const (
 	tokEnd   = "}}"
 	tokBegin = "{{"
+	// trim markers remove the white space, including newlines, on that side of a tag.
+	// A trim marker at the end of a tag must come after white space.
+	tokTrimBegin = "{{-"
+	tokTrimEnd   = "-}}"
 )
 
 const (
@@ -65,9 +68,25 @@ const (
 	itemElse   // only used by parser
 	itemElseIf // only used by parser
 	itemFor
+	itemSwitch
+	itemCase    // only used by parser
+	itemDefault // only used by parser
+	itemEmpty   // only used by parser
 
 	itemJoin
 	itemParam
+
+	itemEscape // turns escaping values by default on or off
+
+	itemMessage // a message to translate, with values to put in it
+
+	itemCall // substitutes a named block, giving it the text up to the matching {{call}} tag as the content of its slots
+	itemSlot // substitutes the content given to a slot of the named block being substituted
+	itemFill // starts the content of a named slot inside of a call tag
+
+	itemExtends // makes the file an extension of another file, whose blocks the rest of the file overrides
+	itemBlock   // a block of content that a file that extends the file can override
+	itemSuper   // substitutes the content that the block being scanned overrides
 )
 
 var tokens map[string]tokenItem
@@ -89,6 +108,11 @@ func init() {
 	tokens["{{se"] = tokenItem{typ: itemString, escaped: false, withError: true}
 	tokens["{{string,err"] = tokenItem{typ: itemString, escaped: false, withError: true}
 
+	// raw strings are never escaped, even when escaping is on by default
+	tokens["{{raw"] = tokenItem{typ: itemString, raw: true, withError: false}
+	tokens["{{rawe"] = tokenItem{typ: itemString, raw: true, withError: true}
+	tokens["{{raw,err"] = tokenItem{typ: itemString, raw: true, withError: true}
+
 	// It doesn't make sense to html escape booleans, integers, etc
 	tokens["{{b"] = tokenItem{typ: itemBool, escaped: false, withError: false}
 	tokens["{{bool"] = tokenItem{typ: itemBool, escaped: false, withError: false}
@@ -131,6 +155,8 @@ func init() {
 	tokens["{{T"] = tokenItem{typ: itemGoType, escaped: false, withError: false}
 	tokens["{{PT"] = tokenItem{typ: itemGoTypeWithPackage, escaped: false, withError: false}
 
+	tokens["{{escape"] = tokenItem{typ: itemEscape} // must follow with on or off
+
 	tokens["{{#"] = tokenItem{typ: itemComment}
 	tokens["{{//"] = tokenItem{typ: itemComment}
 
@@ -155,11 +181,27 @@ func init() {
 	tokens["{{>?"] = tokenItem{typ: itemSubstitute, optional: true}   // must follow with a name and a close tag
 	tokens["{{put?"] = tokenItem{typ: itemSubstitute, optional: true} // must follow with a name and a close tag
 
+	tokens["{{call"] = tokenItem{typ: itemCall} // must follow with a name, optional parameters and a close tag
+	tokens["{{call}}"] = tokenItem{typ: itemEndBlock, val: "call"}
+	tokens["{{slot"] = tokenItem{typ: itemSlot} // may follow with a slot name
+	tokens["{{slot}}"] = tokenItem{typ: itemSlot}
+	tokens["{{fill"] = tokenItem{typ: itemFill} // only used inside of a call tag
+	tokens["{{fill}}"] = tokenItem{typ: itemEndBlock, val: "fill"}
+
+	tokens["{{extends"] = tokenItem{typ: itemExtends} // must follow with a file name
+	tokens["{{block"] = tokenItem{typ: itemBlock}     // must follow with a name and a close tag
+	tokens["{{super}}"] = tokenItem{typ: itemSuper}
+
 	tokens["{{!t"] = tokenItem{typ: itemText, escaped: true, translate: true}
 	tokens["{{!translate"] = tokenItem{typ: itemText, escaped: true, translate: true}
 	tokens["{{t"] = tokenItem{typ: itemText, escaped: false, translate: true}
 	tokens["{{translate"] = tokenItem{typ: itemText, escaped: false, translate: true}
 
+	tokens["{{msg"] = tokenItem{typ: itemMessage} // must follow with parameters and a close tag
+	tokens["{{!msg"] = tokenItem{typ: itemMessage, escaped: true}
+	tokens["{{plural}}"] = tokenItem{typ: itemEndBlock, val: "plural"}
+	tokens["{{msg}}"] = tokenItem{typ: itemEndBlock, val: "msg"}
+
 	tokens["{{:"] = tokenItem{typ: itemInclude}                                                                  // must follow with a file name
 	tokens["{{include"] = tokenItem{typ: itemInclude}                                                            // must follow with a file name
 	tokens["{{:h"] = tokenItem{typ: itemInclude, escaped: true, withError: false, htmlBreaks: true}              // must follow with a file name
@@ -175,27 +217,45 @@ func init() {
 	tokens["{{for"] = tokenItem{typ: itemFor} // Outputs a go "for" statement
 	tokens["{{for}}"] = tokenItem{typ: itemEndBlock, val: "for"}
 
+	tokens["{{switch"] = tokenItem{typ: itemSwitch} // Outputs a go "switch" statement
+	tokens["{{switch}}"] = tokenItem{typ: itemEndBlock, val: "switch"}
+	tokens["{{case"] = tokenItem{typ: itemEndBlock, val: "case"}
+	tokens["{{default}}"] = tokenItem{typ: itemEndBlock, val: "default"}
+
 	tokens["{{join"] = tokenItem{typ: itemJoin} // Like a string.Join statement
 	tokens["{{join}}"] = tokenItem{typ: itemEndBlock, val: "join"}
 
+	tokens["{{empty}}"] = tokenItem{typ: itemEndBlock, val: "empty"} // Starts the text to output if a for or join loop did not run
+
 	tokens["}}"] = tokenItem{typ: itemEnd}
 }
 
-func (t tokenItem) formatError() (s string) {
-	if t.typ == itemError {
-		s = "*** Error: " + t.val + "\n"
-		for _, c := range t.callStack {
-			s += "    " + c.formatErrorLine() + "\n"
+// sourceLocation returns the location in a template file that the item came from. Items that came from a named block
+// are located inside the block's definition if the block was defined in a file, or otherwise where the block was substituted.
+// ok is false if the item did not come from a file.
+func (t tokenItem) sourceLocation() (ref locationRef, ok bool) {
+	cs := t.callStack
+	if len(cs) == 0 {
+		return
+	}
+	if cs[0].blockName == "" {
+		return cs[0], cs[0].fileName != ""
+	}
+	if len(cs) > 1 && cs[1].blockName == "" && cs[1].fileName != "" {
+		// the block definition ref is the start of the block's text
+		ref = cs[1]
+		if cs[0].lineNum == 0 {
+			ref.offset += cs[0].offset
+		} else {
+			ref.lineNum += cs[0].lineNum
+			ref.offset = cs[0].offset
 		}
+		return ref, true
 	}
-	return
-}
-
-func (r locationRef) formatErrorLine() (s string) {
-	if r.blockName != "" {
-		s += fmt.Sprintf("Block %s:%d:%d", r.blockName, r.lineNum+1, r.offset)
-	} else {
-		s += fmt.Sprintf("%s:%d:%d", r.fileName, r.lineNum+1, r.offset)
+	for _, r := range cs[1:] {
+		if r.blockName == "" && r.fileName != "" {
+			return r, true
+		}
 	}
 	return
 }
@@ -0,0 +1,133 @@
+package got
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// watchInterval is how often Watch looks for changed files.
+var watchInterval = 250 * time.Millisecond
+
+// watchSettle is how long the watched files must stay unchanged before Watch processes them. This
+// coalesces the bursts of writes that editors make when saving.
+var watchSettle = 500 * time.Millisecond
+
+// Watch processes the templates described by opts, and then keeps running, processing them again
+// whenever a template or one of the files it includes changes. It returns when done is closed.
+//
+// Only templates whose output files are out of date are processed again, using the same dependency
+// information as a normal run. Templates that failed are tried again after the next change.
+// Errors do not stop the watch, but are written to ErrWriter.
+func Watch(opts Options, done <-chan struct{}) error {
+	r, err := newRunner(opts)
+	if err != nil {
+		return err
+	}
+
+	failed, err := r.watchPass(opts.Force, nil)
+	if err != nil {
+		return err
+	}
+
+	last := r.watchSnapshot()
+	var changedAt time.Time
+	pending := false
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+
+		if snap := r.watchSnapshot(); !sameSnapshot(snap, last) {
+			last = snap
+			changedAt = time.Now()
+			pending = true
+			continue
+		}
+		if !pending || time.Since(changedAt) < watchSettle {
+			continue
+		}
+		pending = false
+		if failed, err = r.watchPass(false, failed); err != nil {
+			return err
+		}
+		// processing may have changed the list of dependencies
+		last = r.watchSnapshot()
+	}
+}
+
+// watchPass processes the out-of-date templates, plus the templates that failed last time, and returns
+// the templates that failed this time.
+func (r *runner) watchPass(force bool, failed []string) (newFailed []string, err error) {
+	var files []string
+	if files, err = r.gatherFiles(force); err != nil {
+		return nil, err
+	}
+	for _, f := range failed {
+		if !containsString(files, f) {
+			files = append(files, f)
+		}
+	}
+
+	for i, err2 := range r.processFiles(files) {
+		if err2 != nil {
+			newFailed = append(newFailed, files[i])
+			outWriterMutex.Lock()
+			if r.opts.JSONDiagnostics {
+				_ = WriteJSONDiagnostics(ErrWriter, err2)
+			} else {
+				_, _ = fmt.Fprintln(ErrWriter, err2.Error())
+			}
+			outWriterMutex.Unlock()
+		}
+	}
+	return
+}
+
+// watchSnapshot returns the modification times of all the templates and the files they depend on.
+// Missing files are included with a zero time, so that creating them is noticed.
+func (r *runner) watchSnapshot() map[string]time.Time {
+	snap := make(map[string]time.Time)
+	add := func(f string) {
+		var t time.Time
+		if info, err := os.Stat(f); err == nil {
+			t = info.ModTime()
+		}
+		snap[f] = t
+	}
+
+	files, _ := r.gatherFiles(true)
+	for _, f := range files {
+		add(f)
+		for _, dep := range readDependencies(outfilePath(f, r.opts.OutDir)) {
+			add(dep)
+		}
+	}
+	return snap
+}
+
+func sameSnapshot(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if v2, ok := b[k]; !ok || !v2.Equal(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, s2 := range list {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
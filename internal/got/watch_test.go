@@ -0,0 +1,103 @@
+package got
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer lets the test read the output while Watch is writing to it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.b.Reset()
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestWatch(t *testing.T) {
+	savedInterval, savedSettle, savedWriter, savedErrWriter := watchInterval, watchSettle, OutWriter, ErrWriter
+	watchInterval, watchSettle = 10*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		watchInterval, watchSettle, OutWriter, ErrWriter = savedInterval, savedSettle, savedWriter, savedErrWriter
+	}()
+	var out, errOut syncBuffer
+	OutWriter = &out
+	ErrWriter = &errOut
+
+	dir := t.TempDir()
+	tplA := filepath.Join(dir, "a.tpl.got")
+	tplB := filepath.Join(dir, "b.tpl.got")
+	inc := filepath.Join(dir, "a.inc")
+	tpl := func(body string) []byte {
+		return []byte("package a\n\nfunc F(_w io.Writer) (err error) {\n" + body + "\nreturn\n}\n")
+	}
+	assert.NoError(t, os.WriteFile(tplA, tpl("{{: a.inc }}"), 0644))
+	assert.NoError(t, os.WriteFile(tplB, tpl("{{ b }}"), 0644))
+	assert.NoError(t, os.WriteFile(inc, []byte("{{ one }}"), 0644))
+
+	done := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		finished <- Watch(Options{Type: "got", InputDirectory: dir, Verbose: true}, done)
+	}()
+
+	waitFor := func(what string) bool {
+		return assert.Eventually(t, func() bool {
+			return strings.Contains(out.String(), what)
+		}, 5*time.Second, 10*time.Millisecond, what)
+	}
+
+	waitFor("b.tpl.got")
+	waitFor("a.tpl.got")
+	out.Reset()
+
+	// a burst of saves to the include file only regenerates the template that includes it, once
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, os.WriteFile(inc, []byte("{{ two }}"), 0644))
+		time.Sleep(5 * time.Millisecond)
+	}
+	if waitFor("a.tpl.got") {
+		time.Sleep(200 * time.Millisecond)
+		s := out.String()
+		assert.Equal(t, 1, strings.Count(s, "Processing"), s)
+		assert.NotContains(t, s, "b.tpl.go")
+		b, _ := os.ReadFile(filepath.Join(dir, "a.tpl.go"))
+		assert.Contains(t, string(b), "two")
+	}
+
+	// errors are reported to ErrWriter without stopping the watch
+	out.Reset()
+	assert.NoError(t, os.WriteFile(tplB, tpl("{{: missing.inc }}"), 0644))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(errOut.String(), "missing.inc")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, out.String(), "missing.inc")
+	out.Reset()
+	assert.NoError(t, os.WriteFile(tplB, tpl("{{ fixed }}"), 0644))
+	waitFor("Processing")
+
+	close(done)
+	assert.NoError(t, <-finished)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/goradd/got/internal/got"
@@ -12,6 +14,11 @@ import (
 var args string // A neat little trick to directly test the main function. If we are testing, this will get set.
 
 func main() {
+	if commandArgs := commandLine(); len(commandArgs) > 0 && commandArgs[0] == "extract" {
+		extract(commandArgs[1:])
+		return
+	}
+
 	var outDir string
 	var typ string
 	var runImports bool
@@ -20,10 +27,20 @@ func main() {
 	var verbose bool
 	var recursive bool
 	var force bool
+	var jobs int
+	var watch bool
+	var lineDirectives bool
+	var maxErrors int
+	var maxDepth int
+	var jsonDiagnostics bool
+	var autoEscape bool
+	var escapeSuffixes string
+	var translator string
+	var textTranslator string
 
 	if len(os.Args[1:]) == 0 || args == "testEmpty" {
 		fmt.Println("got processes got template files, turning them into go code to use in your application.")
-		fmt.Println("Usage: got [-o outDir] [-t fileType] [-i] [-I includeDirs] file1 [file2 ...] ")
+		fmt.Println("Usage: got [-o outDir] [-t fileType] [-i] [-I includeDirs] [-j jobs] [-l] [-e maxErrors] [-depth maxDepth] [-html] [-escape suffixes] [-translator expr] [-textTranslator expr] [-json] [-w] file1 [file2 ...] ")
 		fmt.Println("-o: send processed files to the given directory. Otherwise sends to the same directory that the template is in.")
 		fmt.Println("-t: process all files with this suffix in the current directory. Otherwise, specify specific files at the end.")
 		fmt.Println("-i: run goimports on the result files to automatically fix up the import statement and format the file. You will need goimports installed.")
@@ -32,6 +49,19 @@ func main() {
 		fmt.Println("-v: Verbose. Prints information about the files that are being processed.")
 		fmt.Println("-r: Recursively processes directoreis. Must be used with -t, and optionally -d.")
 		fmt.Println("-f: Force processing a file even if output file is not older than input file.")
+		fmt.Println("-j: The number of files to process at the same time. Defaults to 1.")
+		fmt.Println("-l: Adds line directives to the output files, so that Go compiler errors and panics refer to lines in the templates.")
+		fmt.Println("-e: The maximum number of errors to report for each file. Defaults to 10. Use -1 to report all errors.")
+		fmt.Println("-depth: The maximum depth that named blocks and include files can be nested inside each other. Defaults to 100.")
+		fmt.Println("-html: Escapes values to suit where they land in the surrounding HTML, like html/template does.")
+		fmt.Println("-escape: A comma separated list of file name endings, like .html.got. Templates whose names end in one of them html escape values by default.")
+		fmt.Println("-translator: The Go expression for the gotrt.MessageTranslator that msg tags translate their messages with. Defaults to gotrt.Messages.")
+		fmt.Println("-textTranslator: The Go expression for the gotrt.Translator that translate tags translate their text with. Defaults to gotrt.Texts.")
+		fmt.Println("-json: Report errors as JSON, one per line, for use by editors and other tools.")
+		fmt.Println("-w: Watch. Keeps running, and processes files again when they or the files they include change.")
+		fmt.Println()
+		fmt.Println("Usage: got extract [-o catalogFile] [-format pot|json] [-t fileType] [-d dir] [-r] [-I includeDirs] file1 [file2 ...]")
+		fmt.Println("Writes a catalog of the text that the templates send to translators, for translators to work from.")
 		return
 	}
 
@@ -43,6 +73,16 @@ func main() {
 	flag.BoolVar(&verbose, "v", false, "Verbose. Prints information about the files that are being processed.")
 	flag.BoolVar(&recursive, "r", false, "Recursively processes directories. Must be used with -t, and optionally -d.")
 	flag.BoolVar(&force, "f", false, "Force processing a file even if output file is not older than input file.")
+	flag.IntVar(&jobs, "j", 1, "The number of files to process at the same time.")
+	flag.BoolVar(&lineDirectives, "l", false, "Adds line directives to the output files, so that Go compiler errors and panics refer to lines in the templates.")
+	flag.IntVar(&maxErrors, "e", 10, "The maximum number of errors to report for each file. Use -1 to report all errors.")
+	flag.IntVar(&maxDepth, "depth", 100, "The maximum depth that named blocks and include files can be nested inside each other.")
+	flag.BoolVar(&autoEscape, "html", false, "Escapes values to suit where they land in the surrounding HTML.")
+	flag.StringVar(&escapeSuffixes, "escape", "", "A comma separated list of file name endings. Templates whose names end in one of them html escape values by default.")
+	flag.StringVar(&translator, "translator", "", "The Go expression for the gotrt.MessageTranslator that msg tags translate their messages with.")
+	flag.StringVar(&textTranslator, "textTranslator", "", "The Go expression for the gotrt.Translator that translate tags translate their text with.")
+	flag.BoolVar(&jsonDiagnostics, "json", false, "Report errors as JSON, one per line, for use by editors and other tools.")
+	flag.BoolVar(&watch, "w", false, "Watch. Keeps running, and processes files again when they or the files they include change.")
 
 	if args == "" {
 		flag.Parse() // regular run of program
@@ -52,16 +92,94 @@ func main() {
 	}
 	files := flag.Args()
 
-	if err := got.Run(outDir,
-		typ,
-		runImports,
-		includes,
-		inputDirectory,
-		files,
-		verbose,
-		recursive,
-		force); err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, err.Error())
+	opts := got.Options{
+		OutDir:            outDir,
+		Type:              typ,
+		RunImports:        runImports,
+		Includes:          includes,
+		InputDirectory:    inputDirectory,
+		Files:             files,
+		Verbose:           verbose,
+		Recursive:         recursive,
+		Force:             force,
+		Jobs:              jobs,
+		LineDirectives:    lineDirectives,
+		MaxErrors:         maxErrors,
+		JSONDiagnostics:   jsonDiagnostics,
+		MaxExpansionDepth: maxDepth,
+		AutoEscape:        autoEscape,
+		EscapeSuffixes:    strings.Split(escapeSuffixes, ","),
+		Translator:        translator,
+		TextTranslator:    textTranslator,
+	}
+
+	var err error
+	if watch {
+		err = got.Watch(opts, nil)
+	} else {
+		err = got.RunWithOptions(opts)
+	}
+	if err != nil {
+		if jsonDiagnostics {
+			_ = got.WriteJSONDiagnostics(got.ErrWriter, err)
+		} else {
+			_, _ = fmt.Fprintln(got.ErrWriter, err.Error())
+		}
+		os.Exit(1)
+	}
+}
+
+// commandLine returns the arguments that got was run with.
+func commandLine() []string {
+	if args != "" {
+		return strings.Split(args, " ")
+	}
+	return os.Args[1:]
+}
+
+// extract runs the extract command, which writes a catalog of the text in the templates that is sent to translators.
+func extract(arguments []string) {
+	var outFile string
+	var format string
+	var typ string
+	var includes string
+	var inputDirectory string
+	var recursive bool
+
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	flags.StringVar(&outFile, "o", "", "The file to write the catalog to. Otherwise, it is written to standard output.")
+	flags.StringVar(&format, "format", "", "The format of the catalog, pot or json. Defaults to the extension of the -o file, or pot.")
+	flags.StringVar(&typ, "t", "", "Will read all files with this suffix in current directory, or the directory given by the -d directive.")
+	flags.StringVar(&inputDirectory, "d", "", "The directory to search for files if using the -t directive. Otherwise the current directory will be searched.")
+	flags.BoolVar(&recursive, "r", false, "Recursively reads directories. Must be used with -t, and optionally -d.")
+	flags.StringVar(&includes, "I", "", "The list of directories to look in to find template include files.")
+	_ = flags.Parse(arguments)
+
+	if format == "" {
+		format = got.CatalogPOT
+		if strings.EqualFold(filepath.Ext(outFile), ".json") {
+			format = got.CatalogJSON
+		}
+	}
+	opts := got.Options{
+		Type:           typ,
+		Includes:       includes,
+		InputDirectory: inputDirectory,
+		Files:          flags.Args(),
+		Recursive:      recursive,
+	}
+
+	var buf bytes.Buffer
+	err := got.Extract(opts, format, &buf)
+	if err == nil {
+		if outFile == "" {
+			_, err = buf.WriteTo(os.Stdout)
+		} else {
+			err = os.WriteFile(outFile, buf.Bytes(), 0666)
+		}
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(got.ErrWriter, err.Error())
 		os.Exit(1)
 	}
 }
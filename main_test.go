@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/goradd/gofile/pkg/sys"
 	"github.com/goradd/got/internal/got"
@@ -135,6 +136,109 @@ func TestRecursiveGot(t *testing.T) {
 	resetTemplates()
 }
 
+// TestParallelGot runs the recursive test templates with more than one job at a time.
+func TestParallelGot(t *testing.T) {
+	outPath1 := filepath.Join(`./internal`, `testdata`, `src`, `recurse`)
+	outPath2 := filepath.Join(outPath1, `rdir`)
+
+	resetTemplates()
+
+	var b bytes.Buffer
+	got.OutWriter = &b
+
+	err := got.RunWithOptions(got.Options{
+		Type:           "got",
+		InputDirectory: "github.com/goradd/got/internal/testdata/src/recurse",
+		Verbose:        true,
+		Recursive:      true,
+		Force:          true,
+		Jobs:           4,
+	})
+	assert.NoError(t, err)
+
+	files1, _ := filepath.Glob(filepath.Join(outPath1, "*.go"))
+	files2, _ := filepath.Glob(filepath.Join(outPath2, "*.go"))
+	assert.Len(t, files1, 1)
+	assert.Len(t, files2, 1)
+	assert.Equal(t, 2, strings.Count(b.String(), "Processing"))
+
+	resetTemplates()
+}
+
+// Test_parallelErrors checks that every file is processed, and that errors are reported in file order.
+func Test_parallelErrors(t *testing.T) {
+	resetTemplates()
+
+	err := got.RunWithOptions(got.Options{
+		OutDir: "./internal/testdata/template",
+		Files: []string{
+			"./internal/testdata/src/failureTests/tooManyParams.tpl.got",
+			"./internal/testdata/src/failureTests/badInclude.tpl.got",
+			"./internal/testdata/src/failureTests/tooManyEnds.tpl.got",
+		},
+		Force: true,
+		Jobs:  3,
+	})
+	assert.Error(t, err)
+	msg := err.Error()
+	i1 := strings.Index(msg, "tooManyParams")
+	i2 := strings.Index(msg, "badInclude")
+	i3 := strings.Index(msg, "tooManyEnds")
+	assert.True(t, i1 >= 0 && i1 < i2 && i2 < i3, msg)
+}
+
+// TestIncludeStaleness checks that a template is processed again when one of its include files changes.
+func TestIncludeStaleness(t *testing.T) {
+	dir := t.TempDir()
+	tplPath := filepath.Join(dir, "a.tpl.got")
+	incPath := filepath.Join(dir, "a.inc")
+	prePath := filepath.Join(dir, "pre.inc")
+	outPath := filepath.Join(dir, "a.tpl.go")
+	assert.NoError(t, os.WriteFile(tplPath, []byte("package a\n\nfunc F(_w io.Writer) (err error) {\n{{: a.inc }}\nreturn\n}\n"), 0644))
+	assert.NoError(t, os.WriteFile(incPath, []byte("{{ hi }}"), 0644))
+	assert.NoError(t, os.WriteFile(prePath, []byte("{{< greeting }}hi{{end greeting}}"), 0644))
+
+	var b bytes.Buffer
+	got.OutWriter = &b
+	opts := got.Options{
+		Type:           "got",
+		InputDirectory: dir,
+		Includes:       prePath,
+		Verbose:        true,
+	}
+	run := func() bool {
+		b.Reset()
+		assert.NoError(t, got.RunWithOptions(opts))
+		return strings.Contains(b.String(), "Processing")
+	}
+
+	assert.True(t, run())
+	out, _ := os.ReadFile(outPath)
+	assert.Contains(t, string(out), "//got:dependency a.inc\n")
+	assert.Contains(t, string(out), "//got:dependency pre.inc\n")
+
+	assert.False(t, run())
+
+	// make the include file newer than the output
+	old := time.Now().Add(-2 * time.Hour)
+	changed := old.Add(time.Hour)
+	assert.NoError(t, os.Chtimes(outPath, old, old))
+	assert.NoError(t, os.Chtimes(incPath, changed, changed))
+	assert.True(t, run())
+	assert.False(t, run())
+
+	// same for the prepended file
+	assert.NoError(t, os.Chtimes(outPath, old, old))
+	assert.NoError(t, os.Chtimes(prePath, changed, changed))
+	assert.True(t, run())
+
+	// a missing include file makes the output stale too
+	assert.NoError(t, os.Remove(incPath))
+	b.Reset()
+	assert.Error(t, got.RunWithOptions(opts))
+	assert.Contains(t, b.String(), "Processing")
+}
+
 func Test_badFlags1(t *testing.T) {
 	resetTemplates()
 